@@ -0,0 +1,125 @@
+package sgip
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	CALLBACK_MODE_GET  = 0 // GET with the fields in the query string
+	CALLBACK_MODE_JSON = 1 // POST a CallbackDocument in JSON
+)
+
+// CallbackSchemaVersion is the version of CallbackDocument. It is increased
+// only when a field is removed or changes its meaning, new fields may be
+// added in the same version.
+const CallbackSchemaVersion = 1
+
+// the type of a CallbackDocument
+const (
+	CallbackTypeDeliver = "deliver"
+	CallbackTypeReport  = "report"
+	CallbackTypeUserRpt = "userrpt"
+)
+
+// CallbackDocument is the body of a callback in CALLBACK_MODE_JSON. Type
+// tells which one of Deliver, Report and UserRpt is set. Sequence is the
+// sequence of the command received from the SGP, and the times are in
+// RFC 3339 format.
+type CallbackDocument struct {
+	Version     int              `json:"version"`
+	Type        string           `json:"type"`
+	Sequence    string           `json:"sequence"`
+	ReceiveTime string           `json:"receiveTime"`
+	Deliver     *DeliverDocument `json:"deliver,omitempty"`
+	Report      *ReportDocument  `json:"report,omitempty"`
+	UserRpt     *UserRptDocument `json:"userRpt,omitempty"`
+}
+
+// DeliverDocument is a MO message. MsgContent and Reserve are in hex, and
+// Text is absent for binary messages.
+type DeliverDocument struct {
+	UserNumber string  `json:"userNumber"`
+	SpNumber   string  `json:"spNumber"`
+	Tppid      int     `json:"tppid"`
+	Tpudhi     int     `json:"tpudhi"`
+	MsgCoding  int     `json:"msgCoding"`
+	MsgContent string  `json:"msgContent"`
+	Text       *string `json:"text,omitempty"`
+	Reserve    string  `json:"reserve"`
+}
+
+// ReportDocument is the state report of a submit. SubmitSequence is the
+// sequence returned by the submit, in 24 hex digits.
+type ReportDocument struct {
+	SubmitSequence string `json:"submitSequence"`
+	ReportType     int    `json:"reportType"`
+	UserNumber     string `json:"userNumber"`
+	State          int    `json:"state"`
+	ErrorCode      int    `json:"errorCode"`
+
+	// the status of the submit with this report, absent if it is unknown
+	Submit *MessageStatus `json:"submit,omitempty"`
+}
+
+// UserRptDocument is the state report of a user.
+type UserRptDocument struct {
+	SpNumber      string `json:"spNumber"`
+	UserNumber    string `json:"userNumber"`
+	UserCondition int    `json:"userCondition"`
+}
+
+func newCallbackDocument(callbackType string, seq Sequence, receiveTime time.Time) *CallbackDocument {
+	return &CallbackDocument{
+		Version:     CallbackSchemaVersion,
+		Type:        callbackType,
+		Sequence:    seq.String(),
+		ReceiveTime: receiveTime.Format(time.RFC3339Nano),
+	}
+}
+
+func deliverDocument(e *DeliverEvent) []byte {
+	doc := newCallbackDocument(CallbackTypeDeliver, e.Sequence, e.ReceiveTime)
+	doc.Deliver = &DeliverDocument{
+		UserNumber: e.UserNumber,
+		SpNumber:   e.SpNumber,
+		Tppid:      int(e.Tppid),
+		Tpudhi:     int(e.Tpudhi),
+		MsgCoding:  int(e.MsgCoding),
+		MsgContent: bytesToHexString(e.MsgContent),
+		Reserve:    bytesToHexString(e.Reserve[:]),
+	}
+	if text, ok := e.Text(); ok {
+		doc.Deliver.Text = &text
+	}
+
+	b, _ := json.Marshal(doc)
+	return b
+}
+
+func reportDocument(e *ReportEvent) []byte {
+	doc := newCallbackDocument(CallbackTypeReport, e.Sequence, e.ReceiveTime)
+	doc.Report = &ReportDocument{
+		SubmitSequence: e.SubmitSequence.String(),
+		ReportType:     int(e.ReportType),
+		UserNumber:     e.UserNumber,
+		State:          int(e.State),
+		ErrorCode:      int(e.ErrorCode),
+		Submit:         e.Status,
+	}
+
+	b, _ := json.Marshal(doc)
+	return b
+}
+
+func userRptDocument(e *UserRptEvent) []byte {
+	doc := newCallbackDocument(CallbackTypeUserRpt, e.Sequence, e.ReceiveTime)
+	doc.UserRpt = &UserRptDocument{
+		SpNumber:      e.SpNumber,
+		UserNumber:    e.UserNumber,
+		UserCondition: int(e.UserCondition),
+	}
+
+	b, _ := json.Marshal(doc)
+	return b
+}
@@ -0,0 +1,100 @@
+package sgip
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+// a callback received by the test server
+type callbackRequest struct {
+	method      string
+	path        string
+	contentType string
+	doc         CallbackDocument
+}
+
+func TestJsonCallback(t *testing.T) {
+	received := make(chan callbackRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		c := callbackRequest{method: r.Method, path: r.URL.Path, contentType: r.Header.Get("Content-Type")}
+		if err := json.Unmarshal(body, &c.doc); err != nil {
+			t.Errorf("callback body %s: %v", body, err)
+		}
+		received <- c
+	}))
+	defer server.Close()
+
+	h := &HttpCallbackHandler{DeliverCallbackUrl: server.URL + "/deliver", ReportCallbackUrl: server.URL + "/report",
+		UserRptCallbackUrl: server.URL + "/userrpt", Mode: CALLBACK_MODE_JSON, Logger: seelog.Disabled}
+	seq := Sequence{3000012345, 1018120000, 7}
+	submitSeq := Sequence{3000012345, 1018115959, 1}
+	now := time.Now()
+	status := &MessageStatus{Sequence: submitSeq.String(), Segment: 1, Segments: 2, Result: 0, Message: "success", Reports: map[string]MessageStatusReport{}}
+
+	tests := []struct {
+		name  string
+		call  func()
+		path  string
+		check func(doc *CallbackDocument) bool
+	}{
+		{"deliver text", func() {
+			h.OnDeliver(&DeliverEvent{Sequence: seq, ReceiveTime: now, UserNumber: "8613811234567", SpNumber: "10655", MsgCoding: MSG_CODING_UCS2, MsgContent: []byte{0x4f, 0x60, 0x59, 0x7d}})
+		}, "/deliver", func(doc *CallbackDocument) bool {
+			d := doc.Deliver
+			return doc.Type == CallbackTypeDeliver && d != nil && d.UserNumber == "8613811234567" && d.MsgContent == "4F60597D" && d.Text != nil && *d.Text == "你好"
+		}},
+		{"deliver binary", func() {
+			h.OnDeliver(&DeliverEvent{Sequence: seq, ReceiveTime: now, MsgCoding: MSG_CODING_BINARY, MsgContent: []byte{1, 2}})
+		}, "/deliver", func(doc *CallbackDocument) bool {
+			d := doc.Deliver
+			return doc.Type == CallbackTypeDeliver && d != nil && d.MsgCoding == MSG_CODING_BINARY && d.MsgContent == "0102" && d.Text == nil
+		}},
+		{"report", func() {
+			h.OnReport(&ReportEvent{Sequence: seq, ReceiveTime: now, SubmitSequence: submitSeq, UserNumber: "8613811234567", State: reportStateFailed, ErrorCode: 5, Status: status})
+		}, "/report", func(doc *CallbackDocument) bool {
+			r := doc.Report
+			return doc.Type == CallbackTypeReport && r != nil && r.SubmitSequence == submitSeq.String() && r.State == reportStateFailed && r.ErrorCode == 5 &&
+				r.Submit != nil && r.Submit.Sequence == submitSeq.String() && r.Submit.Segments == 2 && r.Submit.Message == "success"
+		}},
+		{"report of an unknown submit", func() {
+			h.OnReport(&ReportEvent{Sequence: seq, ReceiveTime: now, SubmitSequence: submitSeq, CallbackUrl: server.URL + "/campaign/42"})
+		}, "/campaign/42", func(doc *CallbackDocument) bool {
+			return doc.Type == CallbackTypeReport && doc.Report != nil && doc.Report.Submit == nil
+		}},
+		{"userrpt", func() {
+			h.OnUserRpt(&UserRptEvent{Sequence: seq, ReceiveTime: now, SpNumber: "10655", UserNumber: "8613811234567", UserCondition: 2})
+		}, "/userrpt", func(doc *CallbackDocument) bool {
+			u := doc.UserRpt
+			return doc.Type == CallbackTypeUserRpt && u != nil && u.UserNumber == "8613811234567" && u.UserCondition == 2
+		}},
+	}
+
+	for _, tt := range tests {
+		tt.call()
+		var c callbackRequest
+		select {
+		case c = <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no callback", tt.name)
+		}
+
+		doc := &c.doc
+		if c.method != http.MethodPost || c.contentType != "application/json" || c.path != tt.path {
+			t.Errorf("%s: %s %s %s", tt.name, c.method, c.path, c.contentType)
+		}
+		if doc.Version != CallbackSchemaVersion || doc.Sequence != seq.String() || doc.ReceiveTime != now.Format(time.RFC3339Nano) {
+			t.Errorf("%s: version %d sequence %s receiveTime %s", tt.name, doc.Version, doc.Sequence, doc.ReceiveTime)
+		}
+		if !tt.check(doc) {
+			b, _ := json.Marshal(doc)
+			t.Errorf("%s: document %s", tt.name, b)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sgip
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the headers of a signed callback
+const (
+	CallbackTimestampHeader = "X-Sgip-Timestamp"
+	CallbackSignatureHeader = "X-Sgip-Signature"
+)
+
+// the default max difference between the callback timestamp and the clock
+// of the receiver
+const DefaultCallbackMaxSkew = 5 * time.Minute
+
+// the errors of VerifyCallback
+var (
+	ErrCallbackNotSigned    = errors.New("callback is not signed")
+	ErrCallbackBadSignature = errors.New("callback signature is invalid")
+	ErrCallbackExpired      = errors.New("callback timestamp is out of range")
+)
+
+// SignCallback returns the signature of a callback: the hex HMAC-SHA256 with
+// secret over the unix timestamp, the raw query string and the body, joined
+// by "\n". The query string carries the fields of a GET callback, and the
+// body the document of a JSON callback.
+func SignCallback(secret string, timestamp int64, rawQuery string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(rawQuery))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyCallback checks the signature of a callback received by the web
+// service of the business logic. The timestamp must be within maxSkew of
+// now, DefaultCallbackMaxSkew if maxSkew is 0. It returns the body, and
+// r.Body is replaced so it can be read again.
+func VerifyCallback(r *http.Request, secret string, maxSkew time.Duration) ([]byte, error) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	ts := r.Header.Get(CallbackTimestampHeader)
+	signature := r.Header.Get(CallbackSignatureHeader)
+	if ts == "" || signature == "" {
+		return body, ErrCallbackNotSigned
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return body, fmt.Errorf("invalid callback timestamp %q", ts)
+	}
+
+	expected := SignCallback(secret, timestamp, r.URL.RawQuery, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return body, ErrCallbackBadSignature
+	}
+
+	if maxSkew == 0 {
+		maxSkew = DefaultCallbackMaxSkew
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	if skew > maxSkew || skew < -maxSkew {
+		return body, ErrCallbackExpired
+	}
+
+	return body, nil
+}
+
+// add the timestamp and signature headers to a callback request
+func signCallbackRequest(req *http.Request, secret string, body []byte) {
+	timestamp := time.Now().Unix()
+	req.Header.Set(CallbackTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(CallbackSignatureHeader, SignCallback(secret, timestamp, req.URL.RawQuery, body))
+}
@@ -0,0 +1,82 @@
+package sgip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyCallback(t *testing.T) {
+	const secret = "s3cret"
+	now := time.Now().Unix()
+	body := []byte(`{"version":1,"type":"deliver"}`)
+
+	// a callback request, signed by signCallbackRequest unless the headers
+	// are changed by edit
+	newRequest := func(method, query string, body []byte, edit func(r *http.Request)) *http.Request {
+		r := httptest.NewRequest(method, "http://127.0.0.1/callback?"+query, bytes.NewReader(body))
+		signCallbackRequest(r, secret, body)
+		if edit != nil {
+			edit(r)
+		}
+		return r
+	}
+	setTimestamp := func(ts int64) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.Header.Set(CallbackTimestampHeader, strconv.FormatInt(ts, 10))
+			r.Header.Set(CallbackSignatureHeader, SignCallback(secret, ts, r.URL.RawQuery, body))
+		}
+	}
+
+	tests := []struct {
+		name    string
+		r       *http.Request
+		maxSkew time.Duration
+		want    error
+	}{
+		{"get", newRequest("GET", "userNumber=8613811234567&msgContent=616263", nil, nil), 0, nil},
+		{"post", newRequest("POST", "", body, nil), 0, nil},
+		{"not signed", newRequest("POST", "", body, func(r *http.Request) { r.Header.Del(CallbackSignatureHeader) }), 0, ErrCallbackNotSigned},
+		{"no timestamp", newRequest("POST", "", body, func(r *http.Request) { r.Header.Del(CallbackTimestampHeader) }), 0, ErrCallbackNotSigned},
+		{"wrong secret", newRequest("POST", "", body, func(r *http.Request) {
+			r.Header.Set(CallbackSignatureHeader, SignCallback("other", now, "", body))
+		}), 0, ErrCallbackBadSignature},
+		{"changed query", newRequest("GET", "userNumber=1", nil, func(r *http.Request) { r.URL.RawQuery = "userNumber=2" }), 0, ErrCallbackBadSignature},
+		{"changed body", newRequest("POST", "", body, func(r *http.Request) {
+			r.Body = ioutil.NopCloser(bytes.NewReader([]byte(`{"version":2}`)))
+		}), 0, ErrCallbackBadSignature},
+		{"changed timestamp", newRequest("POST", "", body, func(r *http.Request) {
+			r.Header.Set(CallbackTimestampHeader, strconv.FormatInt(now+1, 10))
+		}), 0, ErrCallbackBadSignature},
+		{"old", newRequest("POST", "", body, setTimestamp(now-600)), 0, ErrCallbackExpired},
+		{"future", newRequest("POST", "", body, setTimestamp(now+600)), 0, ErrCallbackExpired},
+		{"old within skew", newRequest("POST", "", body, setTimestamp(now-600)), time.Hour, nil},
+		{"old out of skew", newRequest("POST", "", body, setTimestamp(now-20)), 10 * time.Second, ErrCallbackExpired},
+	}
+
+	for _, tt := range tests {
+		got, err := VerifyCallback(tt.r, secret, tt.maxSkew)
+		if err != tt.want {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+		}
+
+		// the body can be read again
+		again, _ := ioutil.ReadAll(tt.r.Body)
+		if !bytes.Equal(got, again) {
+			t.Errorf("%s: body %q, read again %q", tt.name, got, again)
+		}
+	}
+}
+
+func TestVerifyCallbackBadTimestamp(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://127.0.0.1/callback?a=1", nil)
+	r.Header.Set(CallbackTimestampHeader, "now")
+	r.Header.Set(CallbackSignatureHeader, "00")
+	if _, err := VerifyCallback(r, "s3cret", 0); err == nil {
+		t.Errorf("no error for an invalid timestamp")
+	}
+}
@@ -0,0 +1,82 @@
+package sgip
+
+import (
+	"fmt"
+	"unicode/utf16"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// encode UTF-8 text in msgCoding. If msgCoding is negative, ASCII is used for
+// pure ASCII text and UCS2 for the others.
+func encodeText(text string, msgCoding int) (byte, []byte, error) {
+	if msgCoding < 0 {
+		msgCoding = MSG_CODING_UCS2
+		if isAscii(text) {
+			msgCoding = MSG_CODING_ASCII
+		}
+	}
+
+	switch msgCoding {
+	case MSG_CODING_ASCII:
+		if !isAscii(text) {
+			return 0, nil, fmt.Errorf("text is not ASCII")
+		}
+		return MSG_CODING_ASCII, []byte(text), nil
+	case MSG_CODING_UCS2:
+		// characters out of the BMP, such as emoji, are encoded as surrogate pairs
+		units := utf16.Encode([]rune(text))
+		b := make([]byte, len(units)*2)
+		for i, u := range units {
+			b[i*2] = byte(u >> 8)
+			b[i*2+1] = byte(u)
+		}
+		return MSG_CODING_UCS2, b, nil
+	case MSG_CODING_GBK:
+		b, err := simplifiedchinese.GBK.NewEncoder().Bytes([]byte(text))
+		if err != nil {
+			return 0, nil, fmt.Errorf("text can't be encoded in GBK: %s", err.Error())
+		}
+		return MSG_CODING_GBK, b, nil
+	}
+
+	return 0, nil, fmt.Errorf("msgCoding %02X is not supported for text", msgCoding)
+}
+
+// decode the message content into UTF-8 text. It returns false for binary
+// messages and the content which is not valid in msgCoding.
+func decodeText(msgCoding byte, content []byte) (string, bool) {
+	switch msgCoding {
+	case MSG_CODING_ASCII:
+		if !isAscii(string(content)) {
+			return "", false
+		}
+		return string(content), true
+	case MSG_CODING_UCS2:
+		if len(content)%2 != 0 {
+			return "", false
+		}
+		units := make([]uint16, len(content)/2)
+		for i := range units {
+			units[i] = uint16(content[i*2])<<8 | uint16(content[i*2+1])
+		}
+		return string(utf16.Decode(units)), true
+	case MSG_CODING_GBK:
+		b, err := simplifiedchinese.GBK.NewDecoder().Bytes(content)
+		if err != nil {
+			return "", false
+		}
+		return string(b), true
+	}
+
+	return "", false
+}
+
+func isAscii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
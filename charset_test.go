@@ -0,0 +1,101 @@
+package sgip
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeText(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		msgCoding int
+		want      byte
+		content   []byte
+		ok        bool
+	}{
+		{"auto ascii", "hello", -1, MSG_CODING_ASCII, []byte("hello"), true},
+		{"auto ucs2", "你好", -1, MSG_CODING_UCS2, []byte{0x4f, 0x60, 0x59, 0x7d}, true},
+		{"auto surrogates", "a😀", -1, MSG_CODING_UCS2, []byte{0x00, 0x61, 0xd8, 0x3d, 0xde, 0x00}, true},
+		{"ascii", "hello", MSG_CODING_ASCII, MSG_CODING_ASCII, []byte("hello"), true},
+		{"ascii not ascii", "你好", MSG_CODING_ASCII, 0, nil, false},
+		{"ucs2 ascii", "a", MSG_CODING_UCS2, MSG_CODING_UCS2, []byte{0x00, 0x61}, true},
+		{"gbk", "a你好", MSG_CODING_GBK, MSG_CODING_GBK, []byte{'a', 0xc4, 0xe3, 0xba, 0xc3}, true},
+		{"gbk emoji", "😀", MSG_CODING_GBK, 0, nil, false},
+		{"binary", "hello", MSG_CODING_BINARY, 0, nil, false},
+	}
+
+	for _, tt := range tests {
+		msgCoding, content, err := encodeText(tt.text, tt.msgCoding)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v", tt.name, err)
+			continue
+		}
+		if msgCoding != tt.want || !bytes.Equal(content, tt.content) {
+			t.Errorf("%s: %02X %X, want %02X %X", tt.name, msgCoding, content, tt.want, tt.content)
+		}
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name      string
+		msgCoding byte
+		content   []byte
+		want      string
+		ok        bool
+	}{
+		{"ascii", MSG_CODING_ASCII, []byte("hello"), "hello", true},
+		{"ascii high bit", MSG_CODING_ASCII, []byte{'a', 0xff}, "", false},
+		{"ucs2", MSG_CODING_UCS2, []byte{0x4f, 0x60, 0x59, 0x7d}, "你好", true},
+		{"ucs2 surrogates", MSG_CODING_UCS2, []byte{0xd8, 0x3d, 0xde, 0x00}, "😀", true},
+		{"ucs2 odd length", MSG_CODING_UCS2, []byte{0x4f, 0x60, 0x59}, "", false},
+		{"gbk", MSG_CODING_GBK, []byte{'a', 0xc4, 0xe3, 0xba, 0xc3}, "a你好", true},
+		{"binary", MSG_CODING_BINARY, []byte("hello"), "", false},
+	}
+
+	for _, tt := range tests {
+		text, ok := decodeText(tt.msgCoding, tt.content)
+		if ok != tt.ok || text != tt.want {
+			t.Errorf("%s: %q %v, want %q %v", tt.name, text, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDeliverEventText(t *testing.T) {
+	tests := []struct {
+		name string
+		e    DeliverEvent
+		want string
+	}{
+		{"plain", DeliverEvent{MsgCoding: MSG_CODING_UCS2, MsgContent: []byte{0x4f, 0x60}}, "你"},
+		{"udh", DeliverEvent{Tpudhi: 1, MsgCoding: MSG_CODING_UCS2, MsgContent: []byte{5, 0, 3, 1, 2, 1, 0x4f, 0x60}}, "你"},
+		{"udh ascii", DeliverEvent{Tpudhi: 1, MsgCoding: MSG_CODING_ASCII, MsgContent: []byte{5, 0, 3, 1, 2, 2, 'h', 'i'}}, "hi"},
+	}
+
+	for _, tt := range tests {
+		if text, ok := tt.e.Text(); !ok || text != tt.want {
+			t.Errorf("%s: %q %v, want %q", tt.name, text, ok, tt.want)
+		}
+	}
+}
+
+func TestSplitContentSurrogates(t *testing.T) {
+	// a surrogate pair at every boundary of 4 bytes shifted by one unit
+	content := []byte{0x00, 0x61, 0xd8, 0x3d, 0xde, 0x00, 0xd8, 0x3d, 0xde, 0x00}
+	parts := splitContent(content, MSG_CODING_UCS2, 5)
+
+	var joined []byte
+	for i, p := range parts {
+		if len(p) > 4 || len(p)%2 != 0 || isHighSurrogate(p[len(p)-2:]) {
+			t.Errorf("part %d %X splits a character", i+1, p)
+		}
+		if text, ok := decodeText(MSG_CODING_UCS2, p); !ok || text == "" {
+			t.Errorf("part %d %X is not valid text", i+1, p)
+		}
+		joined = append(joined, p...)
+	}
+	if !bytes.Equal(joined, content) {
+		t.Errorf("joined parts %X, want %X", joined, content)
+	}
+}
@@ -0,0 +1,248 @@
+package sgip
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// message coding
+const (
+	MSG_CODING_ASCII  = 0
+	MSG_CODING_BINARY = 4
+	MSG_CODING_UCS2   = 8
+	MSG_CODING_GBK    = 15
+)
+
+const (
+	// the max octets of a short message
+	maxUserDataLen = 140
+
+	// the max ASCII characters of a short message without UDH, the SMSC packs
+	// them in 7 bits. A segment with UDH is sent unpacked in 8-bit octets, so
+	// it has at most maxUserDataLen octets with the UDH in any coding.
+	maxAsciiLen = 160
+
+	// the max segments of a concatenated short message
+	maxSegmentCount = 255
+
+	// UDH information element identifier of concatenated short message
+	udhIeConcat8  = 0x00
+	udhIeConcat16 = 0x08
+)
+
+// the key of a long MO message
+type concatKey struct {
+	userNumber string
+	spNumber   string
+	ref        int
+	total      int
+}
+
+// the received parts of a long MO message
+type concatParts struct {
+	parts []*deliver // indexed by the segment number - 1
+	count int
+	timer *time.Timer
+}
+
+// split a long message into concatenated segments, every segment has an UDH
+// with the concatenation information element. A message which fits in one
+// short message, or already has an UDH, is returned as it is.
+func (srv *Server) segmentSubmit(input *submitInput) ([]submitInput, error) {
+	if input.tpudhi != 0 || len(input.msgContent) <= maxSingleLen(input.msgCoding) {
+		return []submitInput{*input}, nil
+	}
+
+	udhLen := 6
+	if srv.config.ConcatRef16Bit {
+		udhLen = 7
+	}
+	parts := splitContent(input.msgContent, input.msgCoding, maxUserDataLen-udhLen)
+	if len(parts) > maxSegmentCount {
+		return nil, fmt.Errorf("message is too long, it needs %d segments", len(parts))
+	}
+
+	ref := atomic.AddUint32(&srv.concatRefCounter, 1)
+	segments := make([]submitInput, len(parts))
+	for i, part := range parts {
+		var udh []byte
+		if srv.config.ConcatRef16Bit {
+			udh = []byte{6, udhIeConcat16, 4, byte(ref >> 8), byte(ref), byte(len(parts)), byte(i + 1)}
+		} else {
+			udh = []byte{5, udhIeConcat8, 3, byte(ref), byte(len(parts)), byte(i + 1)}
+		}
+
+		segments[i] = *input
+		segments[i].tpudhi = 1
+		segments[i].msgContent = append(udh, part...)
+	}
+
+	return segments, nil
+}
+
+// the max length of msgContent without UDH in one short message
+func maxSingleLen(msgCoding byte) int {
+	if msgCoding == MSG_CODING_ASCII {
+		return maxAsciiLen
+	}
+	return maxUserDataLen
+}
+
+// split content into parts of at most size bytes, without breaking a character
+func splitContent(content []byte, msgCoding byte, size int) [][]byte {
+	if msgCoding == MSG_CODING_UCS2 {
+		size &^= 1
+	}
+
+	parts := make([][]byte, 0, len(content)/size+1)
+	for len(content) > 0 {
+		n := len(content)
+		if n > size {
+			n = size
+			if msgCoding == MSG_CODING_GBK {
+				n = gbkBoundary(content, size)
+			} else if msgCoding == MSG_CODING_UCS2 && isHighSurrogate(content[n-2:n]) {
+				n -= 2
+			}
+		}
+
+		parts = append(parts, content[:n])
+		content = content[n:]
+	}
+
+	return parts
+}
+
+// the UCS2 code unit is the first half of a surrogate pair
+func isHighSurrogate(unit []byte) bool {
+	return unit[0] >= 0xD8 && unit[0] <= 0xDB
+}
+
+// the largest length not more than size which doesn't split a GBK double-byte character
+func gbkBoundary(content []byte, size int) int {
+	i := 0
+	for i < len(content) {
+		n := 1
+		if content[i] >= 0x81 && content[i] <= 0xFE {
+			n = 2
+		}
+		if i+n > size {
+			break
+		}
+		i += n
+	}
+
+	return i
+}
+
+// parse the concatenation information element in the UDH of content.
+// udhLen is the length of the whole UDH including the UDHL byte.
+func parseConcatUdh(content []byte) (ref, total, seq, udhLen int, ok bool) {
+	if len(content) < 1 || int(content[0])+1 > len(content) {
+		return 0, 0, 0, 0, false
+	}
+	udhLen = int(content[0]) + 1
+
+	for i := 1; i+1 < udhLen; {
+		ie, ieLen := content[i], int(content[i+1])
+		data := content[i+2:]
+		if i+2+ieLen > udhLen {
+			break
+		}
+		if ie == udhIeConcat8 && ieLen == 3 {
+			ref, total, seq = int(data[0]), int(data[1]), int(data[2])
+			ok = true
+		} else if ie == udhIeConcat16 && ieLen == 4 {
+			ref, total, seq = int(data[0])<<8|int(data[1]), int(data[2]), int(data[3])
+			ok = true
+		}
+		i += 2 + ieLen
+	}
+
+	if ok && (total == 0 || seq == 0 || seq > total) {
+		ok = false
+	}
+	return ref, total, seq, udhLen, ok
+}
+
+// the content after the UDH
+func stripUdh(content []byte) []byte {
+	if len(content) < 1 || int(content[0])+1 > len(content) {
+		return content
+	}
+	return content[int(content[0])+1:]
+}
+
+// add a deliver to the reassembly buffer. It returns the deliver itself if it
+// isn't a part of a long message, the joined deliver if all the parts have
+// arrived, or nil if it still waits for the other parts.
+func (srv *Server) reassembleDeliver(m *deliver) *deliver {
+	if m.tpudhi == 0 {
+		return m
+	}
+	ref, total, seq, _, ok := parseConcatUdh(m.msgContent)
+	if !ok || total == 1 {
+		return m
+	}
+
+	key := concatKey{m.userNumber, m.spNumber, ref, total}
+	srv.concatLock.Lock()
+	defer srv.concatLock.Unlock()
+
+	c, exist := srv.concatBuffer[key]
+	if !exist {
+		c = &concatParts{parts: make([]*deliver, total)}
+		c.timer = time.AfterFunc(srv.concatTimeout(), func() { srv.flushConcat(key, c) })
+		srv.concatBuffer[key] = c
+	}
+	if c.parts[seq-1] == nil {
+		c.count++
+	}
+	c.parts[seq-1] = m
+	if c.count < total {
+		return nil
+	}
+
+	c.timer.Stop()
+	delete(srv.concatBuffer, key)
+	return joinDeliver(c.parts)
+}
+
+// join the parts of a long message, the UDH of every part is removed
+func joinDeliver(parts []*deliver) *deliver {
+	msg := *parts[0]
+	msg.tpudhi = 0
+	msg.msgContent = make([]byte, 0, len(parts)*maxUserDataLen)
+	for _, p := range parts {
+		msg.msgContent = append(msg.msgContent, stripUdh(p.msgContent)...)
+	}
+	msg.msgLength = len(msg.msgContent)
+
+	return &msg
+}
+
+// some parts are missing after the timeout, callback the received parts as they are
+func (srv *Server) flushConcat(key concatKey, c *concatParts) {
+	srv.concatLock.Lock()
+	if srv.concatBuffer[key] != c {
+		srv.concatLock.Unlock()
+		return
+	}
+	delete(srv.concatBuffer, key)
+	srv.concatLock.Unlock()
+
+	srv.config.Logger.Warnf("long message from %s is not complete, %d of %d parts received", key.userNumber, c.count, key.total)
+	for _, p := range c.parts {
+		if p != nil {
+			p.callback(srv)
+		}
+	}
+}
+
+func (srv *Server) concatTimeout() time.Duration {
+	if srv.config.ConcatTimeoutSecond > 0 {
+		return time.Duration(srv.config.ConcatTimeoutSecond) * time.Second
+	}
+	return 60 * time.Second
+}
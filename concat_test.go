@@ -0,0 +1,212 @@
+package sgip
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+// a Handler which passes the events to the test
+type eventHandler struct {
+	events chan interface{}
+}
+
+func (h *eventHandler) OnDeliver(e *DeliverEvent) { h.events <- e }
+func (h *eventHandler) OnReport(e *ReportEvent)   { h.events <- e }
+func (h *eventHandler) OnUserRpt(e *UserRptEvent) { h.events <- e }
+
+func newConcatServer() (*Server, *eventHandler) {
+	h := &eventHandler{make(chan interface{}, 16)}
+	srv := &Server{config: SgipConfig{Logger: seelog.Disabled}, handler: h, concatBuffer: make(map[concatKey]*concatParts)}
+	return srv, h
+}
+
+// a part of a long MO message with the 8-bit reference UDH
+func deliverPart(ref, total, seq int, text string) *deliver {
+	m := &deliver{userNumber: "8613811234567", spNumber: "10655", tpudhi: 1}
+	m.msgContent = append([]byte{5, udhIeConcat8, 3, byte(ref), byte(total), byte(seq)}, text...)
+	return m
+}
+
+func TestSegmentSubmit(t *testing.T) {
+	// a UCS2 text whose surrogate pairs cross the segment boundaries
+	ucs2 := bytes.Repeat([]byte{0x4f, 0x60}, 66)
+	for i := 0; i < 30; i++ {
+		ucs2 = append(ucs2, 0xd8, 0x3d, 0xde, 0x00)
+	}
+
+	tests := []struct {
+		name      string
+		msgCoding byte
+		content   []byte
+		ref16     bool
+		segments  int
+	}{
+		{"ascii single", MSG_CODING_ASCII, []byte(strings.Repeat("a", 160)), false, 1},
+		{"ascii long", MSG_CODING_ASCII, []byte(strings.Repeat("a", 161)), false, 2},
+		{"ascii long 16-bit ref", MSG_CODING_ASCII, []byte(strings.Repeat("a", 400)), true, 4},
+		{"binary", MSG_CODING_BINARY, bytes.Repeat([]byte{0xff}, 141), false, 2},
+		{"ucs2 single", MSG_CODING_UCS2, bytes.Repeat([]byte{0x4f, 0x60}, 70), false, 1},
+		{"ucs2 surrogates", MSG_CODING_UCS2, ucs2, false, 2},
+		{"ucs2 surrogates 16-bit ref", MSG_CODING_UCS2, ucs2, true, 2},
+		{"gbk", MSG_CODING_GBK, append([]byte("a"), bytes.Repeat([]byte{0xc4, 0xe3}, 100)...), false, 2},
+	}
+
+	for _, tt := range tests {
+		srv := &Server{config: SgipConfig{ConcatRef16Bit: tt.ref16}}
+		input := &submitInput{msgCoding: tt.msgCoding, msgContent: tt.content}
+		segments, err := srv.segmentSubmit(input)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if len(segments) != tt.segments {
+			t.Fatalf("%s: %d segments, want %d", tt.name, len(segments), tt.segments)
+		}
+		if len(segments) == 1 {
+			if !bytes.Equal(segments[0].msgContent, tt.content) || segments[0].tpudhi != 0 {
+				t.Errorf("%s: single message is changed", tt.name)
+			}
+			continue
+		}
+
+		var joined []byte
+		for i, s := range segments {
+			if len(s.msgContent) > maxUserDataLen {
+				t.Errorf("%s: segment %d has %d octets, more than %d", tt.name, i+1, len(s.msgContent), maxUserDataLen)
+			}
+			if s.tpudhi != 1 {
+				t.Errorf("%s: segment %d tpudhi is %d", tt.name, i+1, s.tpudhi)
+			}
+
+			ref, total, seq, udhLen, ok := parseConcatUdh(s.msgContent)
+			if !ok || total != len(segments) || seq != i+1 || ref != int(srv.concatRefCounter) {
+				t.Errorf("%s: segment %d udh is %X", tt.name, i+1, s.msgContent[:udhLen])
+			}
+			if wantUdh := map[bool]int{false: 6, true: 7}[tt.ref16]; udhLen != wantUdh {
+				t.Errorf("%s: segment %d udh length %d, want %d", tt.name, i+1, udhLen, wantUdh)
+			}
+
+			part := s.msgContent[udhLen:]
+			if tt.msgCoding == MSG_CODING_UCS2 && (len(part)%2 != 0 || isHighSurrogate(part[len(part)-2:])) {
+				t.Errorf("%s: segment %d splits a character", tt.name, i+1)
+			}
+			if tt.msgCoding == MSG_CODING_GBK && gbkBoundary(part, len(part)) != len(part) {
+				t.Errorf("%s: segment %d splits a character", tt.name, i+1)
+			}
+			joined = append(joined, part...)
+		}
+		if !bytes.Equal(joined, tt.content) {
+			t.Errorf("%s: joined segments differ from the content", tt.name)
+		}
+	}
+}
+
+func TestSegmentSubmitKeepsUdh(t *testing.T) {
+	srv := &Server{}
+	content := append([]byte{5, 0, 3, 1, 2, 1}, bytes.Repeat([]byte("a"), 200)...)
+	segments, err := srv.segmentSubmit(&submitInput{tpudhi: 1, msgContent: content})
+	if err != nil || len(segments) != 1 || !bytes.Equal(segments[0].msgContent, content) {
+		t.Errorf("message with udh is split: %d segments, %v", len(segments), err)
+	}
+}
+
+func TestSegmentSubmitTooLong(t *testing.T) {
+	srv := &Server{}
+	content := bytes.Repeat([]byte("a"), (maxUserDataLen-6)*maxSegmentCount+1)
+	if _, err := srv.segmentSubmit(&submitInput{msgContent: content}); err == nil {
+		t.Errorf("no error for %d segments", maxSegmentCount+1)
+	}
+}
+
+func TestReassembleDeliver(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []*deliver
+		want  string // the joined content, empty if it is not complete
+	}{
+		{"in order", []*deliver{deliverPart(1, 3, 1, "aa"), deliverPart(1, 3, 2, "bb"), deliverPart(1, 3, 3, "cc")}, "aabbcc"},
+		{"out of order", []*deliver{deliverPart(2, 3, 3, "cc"), deliverPart(2, 3, 1, "aa"), deliverPart(2, 3, 2, "bb")}, "aabbcc"},
+		{"duplicate", []*deliver{deliverPart(3, 2, 1, "aa"), deliverPart(3, 2, 1, "aa"), deliverPart(3, 2, 2, "bb")}, "aabb"},
+		{"missing", []*deliver{deliverPart(4, 3, 1, "aa"), deliverPart(4, 3, 3, "cc")}, ""},
+		{"other reference", []*deliver{deliverPart(5, 2, 1, "aa"), deliverPart(6, 2, 2, "bb")}, ""},
+	}
+
+	for _, tt := range tests {
+		srv, _ := newConcatServer()
+		var joined *deliver
+		for i, p := range tt.parts {
+			if m := srv.reassembleDeliver(p); m != nil {
+				if i != len(tt.parts)-1 {
+					t.Errorf("%s: joined after part %d", tt.name, i+1)
+				}
+				joined = m
+			}
+		}
+
+		if tt.want == "" {
+			if joined != nil {
+				t.Errorf("%s: joined an incomplete message", tt.name)
+			}
+			for _, c := range srv.concatBuffer {
+				c.timer.Stop()
+			}
+			continue
+		}
+		if joined == nil {
+			t.Errorf("%s: not joined", tt.name)
+			continue
+		}
+		if string(joined.msgContent) != tt.want || joined.tpudhi != 0 || joined.msgLength != len(tt.want) {
+			t.Errorf("%s: joined %q tpudhi %d, want %q", tt.name, joined.msgContent, joined.tpudhi, tt.want)
+		}
+		if len(srv.concatBuffer) != 0 {
+			t.Errorf("%s: %d messages left in the buffer", tt.name, len(srv.concatBuffer))
+		}
+	}
+}
+
+func TestReassembleDeliverSingle(t *testing.T) {
+	srv, _ := newConcatServer()
+	for _, m := range []*deliver{
+		{msgContent: []byte("hello")},
+		deliverPart(1, 1, 1, "hello"),
+		{tpudhi: 1, msgContent: []byte{3, 0x24, 1, 0, 'h'}}, // no concatenation IE
+	} {
+		if got := srv.reassembleDeliver(m); got != m {
+			t.Errorf("%X is buffered", m.msgContent)
+		}
+	}
+}
+
+func TestFlushConcat(t *testing.T) {
+	srv, h := newConcatServer()
+	srv.config.ConcatTimeoutSecond = 1
+	srv.reassembleDeliver(deliverPart(7, 3, 3, "cc"))
+	srv.reassembleDeliver(deliverPart(7, 3, 1, "aa"))
+
+	// the received parts are passed one by one after the timeout, each
+	// handler runs in its own goroutine so the order is not kept
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-h.events:
+			d := e.(*DeliverEvent)
+			text, _ := d.Text()
+			if d.Tpudhi != 1 {
+				t.Errorf("part %q tpudhi %d", text, d.Tpudhi)
+			}
+			got[text] = true
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%d parts are passed, want 2", i)
+		}
+	}
+	if !got["aa"] || !got["cc"] {
+		t.Errorf("parts %v are passed, want aa and cc", got)
+	}
+	if len(srv.concatBuffer) != 0 {
+		t.Errorf("%d messages left in the buffer", len(srv.concatBuffer))
+	}
+}
@@ -0,0 +1,61 @@
+package sgip
+
+import (
+	"fmt"
+	"io"
+)
+
+// the default max length of a command
+const defaultMaxFrameLength = 4096
+
+// frameLengthError is returned when the command length field is out of range.
+// The stream can't be framed any more, so the connection should be closed.
+type frameLengthError struct {
+	length int
+	max    int
+}
+
+func (e *frameLengthError) Error() string {
+	return fmt.Sprintf("invalid command length %d, it should be in 20-%d", e.length, e.max)
+}
+
+// read one complete command of at most max bytes from r. The command is read into buf if buf is
+// big enough, otherwise a new buffer is allocated. The returned slice holds
+// exactly the command length bytes.
+func readFrame(r io.Reader, buf []byte, max int) ([]byte, error) {
+	if len(buf) < 20 {
+		buf = make([]byte, 20)
+	}
+
+	// read the message head, io.ReadFull keeps reading until all the bytes
+	// arrive, so a command split into several TCP segments is fine
+	if _, err := io.ReadFull(r, buf[:20]); err != nil {
+		return nil, err
+	}
+
+	length := bytesToIntBig(buf[0:4])
+	if length < 20 || length > max {
+		return nil, &frameLengthError{length, max}
+	}
+
+	if len(buf) < length {
+		b := make([]byte, length)
+		copy(b, buf[:20])
+		buf = b
+	}
+	if _, err := io.ReadFull(r, buf[20:length]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return buf[:length], nil
+}
+
+func (srv *Server) maxFrameLength() int {
+	if srv.config.MaxFrameLength > 0 {
+		return srv.config.MaxFrameLength
+	}
+	return defaultMaxFrameLength
+}
@@ -0,0 +1,82 @@
+package sgip
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// a command of length bytes, the body is filled with its index
+func frame(length int) []byte {
+	b := make([]byte, length)
+	b[0], b[1], b[2], b[3] = byte(length>>24), byte(length>>16), byte(length>>8), byte(length)
+	for i := 20; i < length; i++ {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func TestReadFrame(t *testing.T) {
+	two := append(frame(30), frame(100)...)
+
+	tests := []struct {
+		name   string
+		r      io.Reader
+		buf    []byte
+		frames [][]byte
+	}{
+		{"whole", bytes.NewReader(frame(40)), make([]byte, 64), [][]byte{frame(40)}},
+		{"head only", bytes.NewReader(frame(20)), nil, [][]byte{frame(20)}},
+		{"one byte reads", iotest.OneByteReader(bytes.NewReader(frame(40))), make([]byte, 64), [][]byte{frame(40)}},
+		{"half reads", iotest.HalfReader(bytes.NewReader(two)), nil, [][]byte{frame(30), frame(100)}},
+		{"larger than buf", bytes.NewReader(frame(100)), make([]byte, 32), [][]byte{frame(100)}},
+		{"max length", bytes.NewReader(frame(200)), nil, [][]byte{frame(200)}},
+	}
+
+	for _, tt := range tests {
+		for i, want := range tt.frames {
+			got, err := readFrame(tt.r, tt.buf, 200)
+			if err != nil {
+				t.Fatalf("%s: frame %d: %v", tt.name, i+1, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: frame %d is %X, want %X", tt.name, i+1, got, want)
+			}
+		}
+		if _, err := readFrame(tt.r, tt.buf, 200); err != io.EOF {
+			t.Errorf("%s: error %v at the end, want EOF", tt.name, err)
+		}
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"oversized", frame(201), &frameLengthError{201, 200}},
+		{"too short", append(frame(19), 0), &frameLengthError{19, 200}},
+		{"zero length", make([]byte, 20), &frameLengthError{0, 200}},
+		{"huge length", append([]byte{0x7f, 0xff, 0xff, 0xff}, make([]byte, 16)...), &frameLengthError{0x7fffffff, 200}},
+		{"truncated head", frame(40)[:10], io.ErrUnexpectedEOF},
+		{"truncated body", frame(40)[:30], io.ErrUnexpectedEOF},
+		{"no body", frame(40)[:20], io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		_, err := readFrame(iotest.HalfReader(bytes.NewReader(tt.data)), nil, 200)
+		var lengthErr *frameLengthError
+		if want, ok := tt.want.(*frameLengthError); ok {
+			if !errors.As(err, &lengthErr) || lengthErr.length != want.length || lengthErr.max != want.max {
+				t.Errorf("%s: error %v, want %v", tt.name, err, want)
+			}
+			continue
+		}
+		if err != tt.want {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
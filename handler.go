@@ -0,0 +1,234 @@
+package sgip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+// Handler handles the commands received from the SGP. Every method is called
+// in a new goroutine when the command is processed, so it may run before the
+// response has been sent to the SGP. It may block, but it should not modify
+// the event.
+type Handler interface {
+	OnDeliver(e *DeliverEvent)
+	OnReport(e *ReportEvent)
+	OnUserRpt(e *UserRptEvent)
+}
+
+// DeliverEvent is a MO message. The parts of a long message are joined, and
+// the UDH is removed, before OnDeliver is called. If some parts are still
+// missing after ConcatTimeoutSecond, the received parts are passed one by
+// one as they are, with Tpudhi 1 and the UDH in MsgContent, Text skips it.
+// Sequence is the sequence of the Deliver, or of the first part of a long
+// message.
+type DeliverEvent struct {
+	Sequence    Sequence
+	ReceiveTime time.Time
+	UserNumber  string
+	SpNumber    string
+	Tppid       byte
+	Tpudhi      byte
+	MsgCoding   byte
+	MsgContent  []byte
+	Reserve     [8]byte
+}
+
+// ReportEvent is the state report of a submit. CallbackUrl is the callback
+// url given in the submit, or empty if there is none. Status is the status
+// of the submit with this report, or nil if the submit is unknown, such as
+// it was sent before a restart, or the status has expired.
+type ReportEvent struct {
+	Sequence       Sequence // the sequence of the Report
+	ReceiveTime    time.Time
+	SubmitSequence Sequence
+	ReportType     byte
+	UserNumber     string
+	State          byte
+	ErrorCode      byte
+	Reserve        [8]byte
+	CallbackUrl    string
+	Status         *MessageStatus
+}
+
+// UserRptEvent is the state report of a user.
+type UserRptEvent struct {
+	Sequence      Sequence // the sequence of the Userrpt
+	ReceiveTime   time.Time
+	SpNumber      string
+	UserNumber    string
+	UserCondition byte
+}
+
+// Text decodes the message content into UTF-8 text by MsgCoding: ASCII, UCS2
+// or GBK. It returns false for binary messages.
+func (e *DeliverEvent) Text() (string, bool) {
+	content := e.MsgContent
+	if e.Tpudhi != 0 {
+		content = stripUdh(content)
+	}
+	return decodeText(e.MsgCoding, content)
+}
+
+// HttpCallbackHandler calls back the web service of the business logic with
+// a GET request, or a POST request with a CallbackDocument in
+// CALLBACK_MODE_JSON. The userrpt is ignored if UserRptCallbackUrl is empty.
+// With CallbackOutboxDir in the config, the callbacks of the default handler
+// are kept in the outbox and retried until they succeed.
+type HttpCallbackHandler struct {
+	DeliverCallbackUrl string
+	ReportCallbackUrl  string // DeliverCallbackUrl is used if it is empty
+	UserRptCallbackUrl string
+	Mode               int    // CALLBACK_MODE_GET or CALLBACK_MODE_JSON
+	Secret             string // if it is set, the callbacks are signed, see SignCallback
+	Logger             seelog.LoggerInterface
+
+	outbox *outbox // nil if the callbacks are not retried
+}
+
+// the timeout of a callback request
+const callbackTimeout = 30 * time.Second
+
+var callbackClient = &http.Client{Timeout: callbackTimeout}
+
+func (h *HttpCallbackHandler) OnDeliver(e *DeliverEvent) {
+	if h.Mode == CALLBACK_MODE_JSON {
+		h.doCallback(postCallback(h.DeliverCallbackUrl, deliverDocument(e)))
+		return
+	}
+
+	v := url.Values{}
+	v.Set("userNumber", e.UserNumber)
+	v.Set("spNumber", e.SpNumber)
+	v.Set("tppid", fmt.Sprintf("%02X", e.Tppid))
+	v.Set("tpudhi", fmt.Sprintf("%02X", e.Tpudhi))
+	v.Set("msgCoding", fmt.Sprintf("%02X", e.MsgCoding))
+	v.Set("msgContent", bytesToHexString(e.MsgContent))
+	v.Set("reserve", bytesToHexString(e.Reserve[:]))
+
+	// the readable text, it is absent for binary message
+	if text, ok := e.Text(); ok {
+		v.Set("text", text)
+	}
+	h.doCallback(h.getCallback(h.DeliverCallbackUrl, v))
+}
+
+func (h *HttpCallbackHandler) OnReport(e *ReportEvent) {
+	// the callback url of the submit comes first
+	callbackUrl := e.CallbackUrl
+	if callbackUrl == "" {
+		callbackUrl = h.ReportCallbackUrl
+	}
+	if callbackUrl == "" {
+		callbackUrl = h.DeliverCallbackUrl
+	}
+
+	if h.Mode == CALLBACK_MODE_JSON {
+		h.doCallback(postCallback(callbackUrl, reportDocument(e)))
+		return
+	}
+
+	v := url.Values{}
+	v.Set("submitSeq", e.SubmitSequence.String())
+	v.Set("reportType", fmt.Sprintf("%02X", e.ReportType))
+	v.Set("userNumber", e.UserNumber)
+	v.Set("state", fmt.Sprintf("%02X", e.State))
+	v.Set("errorCode", fmt.Sprintf("%02X", e.ErrorCode))
+
+	// the fields of the submit, to find the message without its own mapping
+	if s := e.Status; s != nil {
+		v.Set("spNumber", s.Request.SpNumber)
+		v.Set("serviceType", s.Request.ServiceType)
+		v.Set("msgCoding", fmt.Sprintf("%02X", s.Request.MsgCoding))
+		v.Set("msgContent", s.Request.MsgContent)
+		v.Set("segment", strconv.Itoa(s.Segment))
+		v.Set("segments", strconv.Itoa(s.Segments))
+	}
+	h.doCallback(h.getCallback(callbackUrl, v))
+}
+
+func (h *HttpCallbackHandler) OnUserRpt(e *UserRptEvent) {
+	// the userrpt callback is optional
+	if h.UserRptCallbackUrl == "" {
+		return
+	}
+	if h.Mode == CALLBACK_MODE_JSON {
+		h.doCallback(postCallback(h.UserRptCallbackUrl, userRptDocument(e)))
+		return
+	}
+
+	v := url.Values{}
+	v.Set("spNumber", e.SpNumber)
+	v.Set("userNumber", e.UserNumber)
+	v.Set("userCondition", fmt.Sprintf("%02X", e.UserCondition))
+	h.doCallback(h.getCallback(h.UserRptCallbackUrl, v))
+}
+
+// a GET callback with v in the query string, it returns nil if the url is invalid
+func (h *HttpCallbackHandler) getCallback(callbackUrl string, v url.Values) *outboxEntry {
+	u, err := url.Parse(callbackUrl)
+	if err != nil {
+		h.Logger.Errorf("callback url error :%s", err.Error())
+		return nil
+	}
+	u.RawQuery = v.Encode()
+	return &outboxEntry{Method: http.MethodGet, Url: u.String()}
+}
+
+// a POST callback with a JSON body
+func postCallback(callbackUrl string, body []byte) *outboxEntry {
+	return &outboxEntry{Method: http.MethodPost, Url: callbackUrl, ContentType: "application/json", Body: string(body)}
+}
+
+func (h *HttpCallbackHandler) doCallback(e *outboxEntry) {
+	if e == nil {
+		return
+	}
+
+	// with the outbox, the callback is retried until it succeeds
+	if h.outbox != nil {
+		h.outbox.add(e)
+		return
+	}
+	if err := h.send(e); err != nil {
+		h.Logger.Errorf("callback error :%s", err.Error())
+	}
+}
+
+// send the callback once, a response other than 2xx is an error
+func (h *HttpCallbackHandler) send(e *outboxEntry) error {
+	h.Logger.Infof("callback:%s %s", e.Method, e.Url)
+	req, err := http.NewRequest(e.Method, e.Url, strings.NewReader(e.Body))
+	if err != nil {
+		return err
+	}
+	if e.ContentType != "" {
+		req.Header.Set("Content-Type", e.ContentType)
+	}
+	// sign every attempt, so a retried callback has a fresh timestamp
+	if h.Secret != "" {
+		signCallbackRequest(req, h.Secret, []byte(e.Body))
+	}
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("callback response read error:%s", err.Error())
+	}
+	h.Logger.Infof("callback response :%s", string(b))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback response status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package sgip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/cihub/seelog"
+)
+
+func TestUserRptCallback(t *testing.T) {
+	requests := make(chan *http.Request, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer server.Close()
+
+	e := &UserRptEvent{SpNumber: "10655", UserNumber: "8613811234567", UserCondition: 2}
+
+	// without UserRptCallbackUrl the userrpt is ignored
+	h := &HttpCallbackHandler{DeliverCallbackUrl: server.URL + "/deliver", Logger: seelog.Disabled}
+	h.OnUserRpt(e)
+	select {
+	case r := <-requests:
+		t.Fatalf("userrpt is called back to %s", r.URL)
+	default:
+	}
+
+	h.UserRptCallbackUrl = server.URL + "/userrpt"
+	h.OnUserRpt(e)
+	select {
+	case r := <-requests:
+		want := url.Values{"spNumber": {"10655"}, "userNumber": {"8613811234567"}, "userCondition": {"02"}}
+		if r.Method != http.MethodGet || r.URL.Path != "/userrpt" || r.URL.Query().Encode() != want.Encode() {
+			t.Errorf("userrpt callback %s %s", r.Method, r.URL)
+		}
+	default:
+		t.Fatal("userrpt is not called back")
+	}
+}
@@ -0,0 +1,298 @@
+package sgip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// the state of an asynchronous submit
+const (
+	JOB_STATE_QUEUED    = "queued"    // waiting in the submit queue
+	JOB_STATE_SENT      = "sent"      // accepted by the SGP, waiting the reports
+	JOB_STATE_FAILED    = "failed"    // refused by the SGP, or a report is failed
+	JOB_STATE_DELIVERED = "delivered" // all the reports are successful
+)
+
+// the state of a Report
+const (
+	reportStateOk      = 0
+	reportStateWaiting = 1
+	reportStateFailed  = 2
+)
+
+// the default time to keep a job after its last change
+const defaultJobTtl = 72 * time.Hour
+
+// the default max count of the jobs kept in memory
+const defaultJobMaxCount = 100000
+
+// an asynchronous submit. Every segment to every user has a report, so the
+// job is delivered when all of them are successful. The jobs are kept in
+// memory only: with SubmitQueueDir the queued jobs are restored after
+// restart, but the others are lost.
+type job struct {
+	Id          string    `json:"id"`
+	State       string    `json:"state"`
+	Sequence    string    `json:"sequence,omitempty"`
+	Sequences   []string  `json:"sequences"`
+	Code        int       `json:"code"`
+	Message     string    `json:"message"`
+	Delivered   int       `json:"delivered"`   // the count of successful reports, one per segment and user
+	Undelivered int       `json:"undelivered"` // the count of failed reports, one per segment and user
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+
+	users   int                   // the count of user numbers
+	seqs    []Sequence            // the sequences in jobsBySequence
+	reports map[jobReportKey]bool // true if the report is successful
+}
+
+// a report of a job, the SGP may send a report again if its resp is lost
+type jobReportKey struct {
+	seq        Sequence
+	userNumber string
+}
+
+// put the submit into the queue, and wait its result in background. It
+// returns a copy of the queued job, or the error if the submit is invalid or
+// can't be queued before ctx is done.
+func (srv *Server) submitJob(ctx context.Context, req *SubmitRequest) (*job, error) {
+	input, err := req.input()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	j := &job{Id: newJobId(), State: JOB_STATE_QUEUED, Sequences: []string{}, Code: SUBMIT_CODE_NO_RESP, Created: now, Updated: now, users: len(req.UserNumber)}
+	srv.jobsLock.Lock()
+	srv.putJob(j)
+	srv.sweepJobs(now)
+	srv.jobsLock.Unlock()
+
+	rc, err := srv.enqueueInput(ctx, input, j.Id)
+	if err != nil {
+		srv.jobsLock.Lock()
+		delete(srv.jobs, j.Id)
+		srv.jobsLock.Unlock()
+		return nil, err
+	}
+
+	// every waiting goroutine has a message in the queue or in flight, so
+	// they are bounded by the queue
+	go func() {
+		result, err := newSubmitResult(<-rc)
+		srv.finishJob(j, result, err)
+	}()
+
+	return srv.findJob(j.Id), nil
+}
+
+// register the sequence of a segment of the job id before it is sent, so a
+// report arriving before the submit result finds the job
+func (srv *Server) addJobSequence(id string, seq Sequence) {
+	srv.jobsLock.Lock()
+	defer srv.jobsLock.Unlock()
+
+	if j := srv.jobs[id]; j != nil {
+		srv.jobsBySequence[seq] = j
+		j.seqs = append(j.seqs, seq)
+	}
+}
+
+// set the submit result of a job
+func (srv *Server) finishJob(j *job, result *SubmitResult, err error) {
+	srv.jobsLock.Lock()
+	defer srv.jobsLock.Unlock()
+
+	j.Updated = time.Now()
+	if err == ErrSubmitQueued {
+		// the job is queued again after restart
+		j.Message = result.Message
+		return
+	}
+	if result == nil {
+		j.State = JOB_STATE_FAILED
+		j.Message = err.Error()
+		return
+	}
+
+	for _, seq := range result.Sequences {
+		j.Sequences = append(j.Sequences, seq.String())
+	}
+	if err != nil {
+		j.State = JOB_STATE_FAILED
+		j.Code = result.Code
+		j.Message = result.Message
+		return
+	}
+	j.Sequence = j.Sequences[0]
+	if j.State == JOB_STATE_FAILED {
+		// a report has failed before the submit result
+		return
+	}
+
+	j.Code = result.Code
+	j.Message = result.Message
+	j.State = JOB_STATE_SENT
+	j.checkDelivered()
+}
+
+// update the job of the submit by the report of a user number, a report
+// sent again by the SGP replaces the last one
+func (srv *Server) reportJob(submitSeq Sequence, userNumber string, state byte, errorCode byte) {
+	now := time.Now()
+	srv.jobsLock.Lock()
+	defer srv.jobsLock.Unlock()
+
+	srv.sweepJobs(now)
+	j := srv.jobsBySequence[submitSeq]
+	if j == nil || state == reportStateWaiting {
+		return
+	}
+
+	key := jobReportKey{submitSeq, userNumber}
+	if delivered, ok := j.reports[key]; ok {
+		if delivered {
+			j.Delivered--
+		} else {
+			j.Undelivered--
+		}
+	}
+	j.reports[key] = state == reportStateOk
+
+	j.Updated = now
+	if state == reportStateOk {
+		j.Delivered++
+	} else {
+		j.Undelivered++
+		j.State = JOB_STATE_FAILED
+		j.Code = int(errorCode)
+		j.Message = fmt.Sprintf("report state %d, error code %d", state, errorCode)
+	}
+	j.checkDelivered()
+}
+
+// a sent job is delivered when all the reports are successful
+func (j *job) checkDelivered() {
+	if j.State == JOB_STATE_SENT && j.Delivered >= len(j.Sequences)*j.users {
+		j.State = JOB_STATE_DELIVERED
+	}
+}
+
+// the jobs of the submits left in the submit queue log are queued again
+func (srv *Server) restoreJobs() {
+	now := time.Now()
+	srv.jobsLock.Lock()
+	defer srv.jobsLock.Unlock()
+
+	for _, e := range srv.queue.entries() {
+		if e.JobId == "" || len(e.Segments) == 0 {
+			continue
+		}
+		srv.putJob(&job{Id: e.JobId, State: JOB_STATE_QUEUED, Sequences: []string{}, Code: SUBMIT_CODE_NO_RESP, Created: now, Updated: now, users: len(e.Segments[0].UserNumbers)})
+	}
+}
+
+// set the submit result of the job id, if it exists
+func (srv *Server) finishJobById(id string, result *SubmitResult, err error) {
+	srv.jobsLock.Lock()
+	j := srv.jobs[id]
+	srv.jobsLock.Unlock()
+	if j != nil {
+		srv.finishJob(j, result, err)
+	}
+}
+
+// a copy of the job, or nil if it doesn't exist
+func (srv *Server) findJob(id string) *job {
+	srv.jobsLock.Lock()
+	defer srv.jobsLock.Unlock()
+
+	srv.sweepJobs(time.Now())
+	j := srv.jobs[id]
+	if j == nil {
+		return nil
+	}
+	c := *j
+	c.Sequences = append([]string{}, j.Sequences...)
+	c.seqs = nil
+	c.reports = nil
+	return &c
+}
+
+// add the job, and remove the oldest jobs over the max count, jobsLock must
+// be held
+func (srv *Server) putJob(j *job) {
+	if j.reports == nil {
+		j.reports = make(map[jobReportKey]bool)
+	}
+	srv.jobs[j.Id] = j
+	srv.jobOrder = append(srv.jobOrder, j)
+
+	max := srv.jobMaxCount()
+	for len(srv.jobs) > max {
+		first := srv.jobOrder[0]
+		srv.jobOrder[0] = nil
+		srv.jobOrder = srv.jobOrder[1:]
+		if srv.jobs[first.Id] == first {
+			srv.removeJob(first)
+		}
+	}
+}
+
+// jobsLock must be held
+func (srv *Server) removeJob(j *job) {
+	delete(srv.jobs, j.Id)
+	for _, seq := range j.seqs {
+		if srv.jobsBySequence[seq] == j {
+			delete(srv.jobsBySequence, seq)
+		}
+	}
+}
+
+func (srv *Server) jobMaxCount() int {
+	if srv.config.JobMaxCount > 0 {
+		return srv.config.JobMaxCount
+	}
+	return defaultJobMaxCount
+}
+
+// remove the jobs which have not changed for the ttl, jobsLock must be held
+func (srv *Server) sweepJobs(now time.Time) {
+	if now.Sub(srv.jobsSwept) < reportRouteSweepInterval {
+		return
+	}
+	srv.jobsSwept = now
+
+	ttl := defaultJobTtl
+	if srv.config.JobTtlSecond > 0 {
+		ttl = time.Duration(srv.config.JobTtlSecond) * time.Second
+	}
+	order := srv.jobOrder[:0]
+	for _, j := range srv.jobOrder {
+		if srv.jobs[j.Id] != j {
+			continue
+		}
+		if now.Sub(j.Updated) >= ttl {
+			srv.removeJob(j)
+			continue
+		}
+		order = append(order, j)
+	}
+	for i := len(order); i < len(srv.jobOrder); i++ {
+		srv.jobOrder[i] = nil
+	}
+	srv.jobOrder = order
+}
+
+func newJobId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// never happens on the supported systems
+		panic(err.Error())
+	}
+	return hex.EncodeToString(b)
+}
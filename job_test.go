@@ -0,0 +1,150 @@
+package sgip
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+func newJobServer(t *testing.T, depth int) *Server {
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDepth: depth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+var jobRequest = &SubmitRequest{SpNumber: "10655", UserNumber: []string{"8613811234567"}, CorpId: "12345", ServiceType: "abc", Text: "hello"}
+
+func TestJobEarlyReport(t *testing.T) {
+	seq := Sequence{1, 2, 3}
+	result := &SubmitResult{Sequence: seq, Sequences: []Sequence{seq}, Code: resp_code_ok, Message: "success"}
+
+	tests := []struct {
+		name  string
+		state byte
+		want  string
+	}{
+		{"delivered", reportStateOk, JOB_STATE_DELIVERED},
+		{"failed", reportStateFailed, JOB_STATE_FAILED},
+	}
+
+	for _, tt := range tests {
+		srv := newJobServer(t, 1)
+		j, err := srv.submitJob(context.Background(), jobRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the segment is sent, and its report arrives before the submit result
+		srv.addJobSequence(j.Id, seq)
+		srv.reportJob(seq, "8613811234567", tt.state, 0)
+		srv.finishJobById(j.Id, result, nil)
+
+		j = srv.findJob(j.Id)
+		if j.State != tt.want || j.Sequence != seq.String() {
+			t.Errorf("%s: job state %s sequence %s, want %s", tt.name, j.State, j.Sequence, tt.want)
+		}
+	}
+}
+
+func TestSubmitJobQueueFull(t *testing.T) {
+	srv := newJobServer(t, 1)
+	if _, err := srv.submitJob(context.Background(), jobRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	// the job is not accepted if it can't be queued in time
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	j, err := srv.submitJob(ctx, jobRequest)
+	if err != context.DeadlineExceeded || j != nil {
+		t.Errorf("job %v error %v, want DeadlineExceeded", j, err)
+	}
+	if len(srv.jobs) != 1 {
+		t.Errorf("%d jobs, want 1", len(srv.jobs))
+	}
+
+	if _, err = srv.submitJob(context.Background(), &SubmitRequest{}); err == nil {
+		t.Errorf("no error for an invalid submit")
+	}
+}
+
+func TestJobDuplicateReport(t *testing.T) {
+	srv := newJobServer(t, 1)
+	req := *jobRequest
+	req.UserNumber = []string{"8613811234567", "8613811234568"}
+	j, err := srv.submitJob(context.Background(), &req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := Sequence{1, 2, 3}
+	srv.addJobSequence(j.Id, seq)
+	srv.finishJobById(j.Id, &SubmitResult{Sequence: seq, Sequences: []Sequence{seq}, Code: resp_code_ok, Message: "success"}, nil)
+
+	// the report of the first user is sent again, the second user has none
+	srv.reportJob(seq, "8613811234567", reportStateOk, 0)
+	srv.reportJob(seq, "8613811234567", reportStateOk, 0)
+	if j = srv.findJob(j.Id); j.State != JOB_STATE_SENT || j.Delivered != 1 {
+		t.Errorf("job state %s delivered %d, want sent 1", j.State, j.Delivered)
+	}
+
+	srv.reportJob(seq, "8613811234568", reportStateOk, 0)
+	if j = srv.findJob(j.Id); j.State != JOB_STATE_DELIVERED || j.Delivered != 2 || j.Undelivered != 0 {
+		t.Errorf("job state %s delivered %d undelivered %d, want delivered 2", j.State, j.Delivered, j.Undelivered)
+	}
+}
+
+func TestJobMaxCount(t *testing.T) {
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDepth: 10, JobMaxCount: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for i := 0; i < 5; i++ {
+		j, err := srv.submitJob(context.Background(), jobRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.addJobSequence(j.Id, Sequence{1, 2, uint32(i)})
+		ids = append(ids, j.Id)
+	}
+
+	// the oldest jobs and their sequences are removed
+	for i, id := range ids {
+		if found := srv.findJob(id) != nil; found != (i >= 2) {
+			t.Errorf("job %d found %v", i, found)
+		}
+	}
+	srv.jobsLock.Lock()
+	defer srv.jobsLock.Unlock()
+	if len(srv.jobs) != 3 || len(srv.jobsBySequence) != 3 {
+		t.Errorf("%d jobs, %d sequences, want 3", len(srv.jobs), len(srv.jobsBySequence))
+	}
+}
+
+func TestJobSweepOnFind(t *testing.T) {
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDepth: 1, JobTtlSecond: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := srv.submitJob(context.Background(), jobRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the job expires without any new submit
+	srv.jobsLock.Lock()
+	srv.jobs[j.Id].Updated = time.Now().Add(-2 * time.Second)
+	srv.jobsSwept = time.Time{}
+	srv.jobsLock.Unlock()
+	if srv.findJob(j.Id) != nil {
+		t.Errorf("expired job is found")
+	}
+	if len(srv.jobOrder) != 0 {
+		t.Errorf("%d jobs in the order, want 0", len(srv.jobOrder))
+	}
+}
@@ -0,0 +1,443 @@
+package sgip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/liuben/sgip/pdu"
+)
+
+// the max size of a JSON request body
+const (
+	maxApiBodySize   = 1 << 20
+	maxBatchBodySize = 32 << 20
+)
+
+// the max count of messages in a batch submit
+const maxBatchSize = 10000
+
+// the defaults of the optional SGIP fields in a JSON submit
+const (
+	defaultApiFeeValue   = "0"
+	defaultApiGivenValue = "0"
+	defaultApiMtFlag     = 2 // the MT is not caused by a MO
+	defaultApiReportFlag = 1 // always report
+)
+
+// a submit in JSON. The numbers are decimal, msgContent and reserve are
+// hex. A nil pointer means the field is absent, and its default is used.
+type messageRequest struct {
+	SpNumber     string   `json:"spNumber"`
+	ChargeNumber string   `json:"chargeNumber"`
+	UserNumbers  []string `json:"userNumbers"`
+	CorpId       *string  `json:"corpId"`
+	ServiceType  string   `json:"serviceType"`
+	FeeType      *int     `json:"feeType"`
+	FeeValue     *string  `json:"feeValue"`
+	GivenValue   *string  `json:"givenValue"`
+	AgentFlag    *int     `json:"agentFlag"`
+	MtFlag       *int     `json:"mtFlag"`
+	Priority     *int     `json:"priority"`
+	ExpireTime   string   `json:"expireTime"`
+	ScheduleTime string   `json:"scheduleTime"`
+	ReportFlag   *int     `json:"reportFlag"`
+	Tppid        *int     `json:"tppid"`
+	Tpudhi       *int     `json:"tpudhi"`
+	MsgCoding    *int     `json:"msgCoding"`
+	MsgContent   string   `json:"msgContent"`
+	Text         string   `json:"text"`
+	Reserve      string   `json:"reserve"`
+	CallbackUrl  string   `json:"callbackUrl"`
+}
+
+// the result of a JSON submit
+type messageResponse struct {
+	Sequence  string   `json:"sequence,omitempty"`
+	Sequences []string `json:"sequences"`
+	Code      int      `json:"code"`
+	Message   string   `json:"message"`
+}
+
+// a batch of JSON submits
+type batchRequest struct {
+	Messages []messageRequest `json:"messages"`
+}
+
+// the results of a batch submit, in the order of the messages. A result has
+// the submit result of the message if it is sent, otherwise the error.
+type batchResponse struct {
+	Sent    int            `json:"sent"`
+	Failed  int            `json:"failed"`
+	Results []*batchResult `json:"results"`
+}
+
+type batchResult struct {
+	Index int `json:"index"`
+	*messageResponse
+	Error *apiError `json:"error,omitempty"`
+}
+
+// the error of a JSON request, fields lists every invalid field
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// the codes of apiError
+const (
+	apiCodeForbidden        = "forbidden"
+	apiCodeMethodNotAllowed = "method_not_allowed"
+	apiCodeNotFound         = "not_found"
+	apiCodeInvalidJson      = "invalid_json"
+	apiCodeInvalidRequest   = "invalid_request"
+	apiCodeStopping         = "server_stopping"
+	apiCodeTimeout          = "timeout"
+	apiCodeQueueError       = "queue_error"
+)
+
+// POST /v1/messages, submit a message in JSON. With ?async=1 it returns
+// the queued job at once, and its state is got by GET /v1/messages/{id}.
+func (srv *Server) messagesHandler(w http.ResponseWriter, r *http.Request) {
+	srv.config.Logger.Infof("get message request: %s %s", r.Method, r.URL.String())
+
+	if !srv.checkApiRequest(w, r, http.MethodPost) {
+		return
+	}
+
+	var req messageRequest
+	if !srv.decodeApiBody(w, r, &req, maxApiBodySize) {
+		return
+	}
+	sr, errs := srv.messageSubmitRequest(&req, "")
+	if len(errs) > 0 {
+		writeApiError(w, http.StatusBadRequest, apiCodeInvalidRequest, "request is invalid", errs)
+		return
+	}
+
+	if async := r.URL.Query().Get("async"); async == "1" || async == "true" {
+		j, err := srv.submitJob(r.Context(), sr)
+		if err != nil {
+			status, code := submitErrorStatus(err)
+			writeApiError(w, status, code, err.Error(), nil)
+			return
+		}
+		srv.config.Logger.Infof("message job %s is queued", j.Id)
+		w.Header().Set("Location", "/v1/messages/"+j.Id)
+		writeApiJson(w, http.StatusAccepted, j)
+		return
+	}
+
+	result, err := srv.Submit(r.Context(), sr)
+	if result == nil {
+		status, code := submitErrorStatus(err)
+		writeApiError(w, status, code, err.Error(), nil)
+		return
+	}
+
+	resp := newMessageResponse(result)
+	if err == ErrSubmitQueued {
+		writeApiJson(w, http.StatusAccepted, resp)
+		return
+	}
+	if err != nil {
+		srv.config.Logger.Warnf("message submit error:%s", err.Error())
+		writeApiJson(w, http.StatusBadGateway, resp)
+		return
+	}
+	writeApiJson(w, http.StatusOK, resp)
+}
+
+// GET /v1/messages/{id}, the state of an asynchronous submit
+func (srv *Server) messageJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !srv.checkApiRequest(w, r, http.MethodGet) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/messages/")
+	j := srv.findJob(id)
+	if j == nil {
+		writeApiError(w, http.StatusNotFound, apiCodeNotFound, "message "+id+" is not found", nil)
+		return
+	}
+	writeApiJson(w, http.StatusOK, j)
+}
+
+// GET /v1/status/{sequence}, the status of a submit by its sequence, in 24
+// hex digits or the decimal form
+func (srv *Server) messageStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !srv.checkApiRequest(w, r, http.MethodGet) {
+		return
+	}
+
+	s := strings.TrimPrefix(r.URL.Path, "/v1/status/")
+	seq, err := ParseSequence(s)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, apiCodeInvalidRequest, err.Error(), []fieldError{{"sequence", "is invalid"}})
+		return
+	}
+	status := srv.messageStatus(seq)
+	if status == nil {
+		writeApiError(w, http.StatusNotFound, apiCodeNotFound, "status of "+s+" is not found", nil)
+		return
+	}
+	writeApiJson(w, http.StatusOK, status)
+}
+
+// POST /v1/messages/batch, submit an array of messages in JSON. The valid
+// messages are put into the queue in order, and the response is sent when
+// all of them have the submit results, or the request is done.
+func (srv *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	srv.config.Logger.Infof("get batch request: %s %s", r.Method, r.URL.String())
+
+	if !srv.checkApiRequest(w, r, http.MethodPost) {
+		return
+	}
+
+	var req batchRequest
+	if !srv.decodeApiBody(w, r, &req, maxBatchBodySize) {
+		return
+	}
+	if len(req.Messages) == 0 || len(req.Messages) > maxBatchSize {
+		msg := fmt.Sprintf("should have 1-%d messages", maxBatchSize)
+		writeApiError(w, http.StatusBadRequest, apiCodeInvalidRequest, "request is invalid", []fieldError{{"messages", msg}})
+		return
+	}
+
+	resp := batchResponse{Results: make([]*batchResult, len(req.Messages))}
+	msgs := make([]submitMessage, 0, len(req.Messages))
+	indexes := make([]int, 0, len(req.Messages)) // the message index of msgs
+	for i := range req.Messages {
+		result := &batchResult{Index: i}
+		resp.Results[i] = result
+
+		sr, errs := srv.messageSubmitRequest(&req.Messages[i], fmt.Sprintf("messages[%d].", i))
+		var segments []submitInput
+		if len(errs) == 0 {
+			input, err := sr.input()
+			if err == nil {
+				segments, err = srv.segmentSubmit(input)
+			}
+			if err != nil {
+				errs = []fieldError{{fmt.Sprintf("messages[%d]", i), err.Error()}}
+			}
+		}
+		if len(errs) > 0 {
+			result.Error = &apiError{apiCodeInvalidRequest, "message is invalid", errs}
+			resp.Failed++
+			continue
+		}
+		msgs = append(msgs, submitMessage{para: segments, responseChan: make(chan submitResult, 1)})
+		indexes = append(indexes, i)
+	}
+
+	// the messages are written to the submit queue log with one sync. If the
+	// request is done while the queue is full, the rest of the messages fail
+	// without being queued.
+	queued, err := srv.enqueueSubmits(r.Context(), msgs)
+	for k, msg := range msgs {
+		result := resp.Results[indexes[k]]
+		if k >= queued {
+			_, code := submitErrorStatus(err)
+			result.Error = &apiError{code, err.Error(), nil}
+			resp.Failed++
+			continue
+		}
+
+		// the results are waited in order by this goroutine, the later
+		// ones are kept in their buffered channels meanwhile
+		select {
+		case sr := <-msg.responseChan:
+			sres, err := newSubmitResult(sr)
+			result.messageResponse = newMessageResponse(sres)
+			if err != nil {
+				resp.Failed++
+			} else {
+				resp.Sent++
+			}
+		case <-r.Context().Done():
+			result.Error = &apiError{apiCodeTimeout, "the message is queued, but its result is not got in time", nil}
+			resp.Failed++
+		}
+	}
+
+	srv.config.Logger.Infof("batch submit done, %d sent, %d failed", resp.Sent, resp.Failed)
+	writeApiJson(w, http.StatusOK, resp)
+}
+
+// check the client ip and the method, write the error if it fails
+func (srv *Server) checkApiRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if srv.checkClientIp(r.RemoteAddr, srv.config.SpAppIp) == false {
+		writeApiError(w, http.StatusForbidden, apiCodeForbidden, "client ip is not allowed", nil)
+		return false
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeApiError(w, http.StatusMethodNotAllowed, apiCodeMethodNotAllowed, "method should be "+method, nil)
+		return false
+	}
+	return true
+}
+
+// decode the JSON body of at most limit bytes into v, write the error if it fails
+func (srv *Server) decodeApiBody(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v); err != nil {
+		srv.config.Logger.Warnf("message request is invalid: %s", err.Error())
+		writeApiError(w, http.StatusBadRequest, apiCodeInvalidJson, "invalid JSON: "+err.Error(), nil)
+		return false
+	}
+	return true
+}
+
+// check every field of a JSON submit, and fill the defaults. The names in
+// the errors are prefixed with prefix.
+func (srv *Server) messageSubmitRequest(req *messageRequest, prefix string) (*SubmitRequest, []fieldError) {
+	var errs []fieldError
+	fail := func(field, format string, a ...interface{}) {
+		errs = append(errs, fieldError{prefix + field, fmt.Sprintf(format, a...)})
+	}
+	str := func(field, v string, size int, required bool) string {
+		if v == "" && required {
+			fail(field, "is required")
+		} else if len(v) > size {
+			fail(field, "should be at most %d characters", size)
+		}
+		return v
+	}
+	num := func(field string, v *int, def int) byte {
+		if v == nil {
+			return byte(def)
+		}
+		if *v < 0 || *v > 255 {
+			fail(field, "should be in 0-255")
+			return 0
+		}
+		return byte(*v)
+	}
+	optional := func(v *string, def string) string {
+		if v == nil {
+			return def
+		}
+		return *v
+	}
+
+	s := &SubmitRequest{
+		SpNumber:     str("spNumber", req.SpNumber, 21, true),
+		ChargeNumber: str("chargeNumber", req.ChargeNumber, 21, false),
+		CorpId:       str("corpId", optional(req.CorpId, fmt.Sprintf("%05d", srv.config.CorpId)), 5, true),
+		ServiceType:  str("serviceType", req.ServiceType, 10, true),
+		FeeType:      num("feeType", req.FeeType, 0),
+		FeeValue:     str("feeValue", optional(req.FeeValue, defaultApiFeeValue), 6, false),
+		GivenValue:   str("givenValue", optional(req.GivenValue, defaultApiGivenValue), 6, false),
+		AgentFlag:    num("agentFlag", req.AgentFlag, 0),
+		MtFlag:       num("mtFlag", req.MtFlag, defaultApiMtFlag),
+		Priority:     num("priority", req.Priority, 0),
+		ExpireTime:   str("expireTime", req.ExpireTime, 16, false),
+		ScheduleTime: str("scheduleTime", req.ScheduleTime, 16, false),
+		ReportFlag:   num("reportFlag", req.ReportFlag, defaultApiReportFlag),
+		Tppid:        num("tppid", req.Tppid, 0),
+		Tpudhi:       num("tpudhi", req.Tpudhi, 0),
+		MsgCoding:    num("msgCoding", req.MsgCoding, 0),
+		Text:         req.Text,
+		CallbackUrl:  req.CallbackUrl,
+	}
+
+	if len(req.UserNumbers) == 0 {
+		fail("userNumbers", "is required")
+	} else if len(req.UserNumbers) > pdu.MaxUserCount {
+		fail("userNumbers", "should have at most %d numbers", pdu.MaxUserCount)
+	}
+	for i, un := range req.UserNumbers {
+		str(fmt.Sprintf("userNumbers[%d]", i), un, 21, true)
+	}
+	s.UserNumber = req.UserNumbers
+
+	// the content is text or hex msgContent
+	if req.Text != "" && req.MsgContent != "" {
+		fail("text", "text and msgContent can't be both given")
+	} else if req.Text != "" {
+		msgCoding := -1
+		if req.MsgCoding != nil {
+			msgCoding = *req.MsgCoding
+		}
+		// msgCoding 0 of SubmitRequest is the auto mode, it is the same as
+		// ASCII for the text which passes this check
+		if msgCoding > 255 || msgCoding < -1 {
+			// msgCoding is reported already
+		} else if _, _, err := encodeText(req.Text, msgCoding); err != nil {
+			fail("text", "%s", err.Error())
+		}
+	} else if req.MsgContent != "" {
+		b, err := hexStringToBytes(req.MsgContent)
+		if err != nil || len(req.MsgContent)%2 != 0 {
+			fail("msgContent", "should be hex")
+		}
+		s.MsgContent = b
+	} else {
+		fail("text", "text or msgContent is required")
+	}
+
+	if req.Reserve != "" {
+		b, err := hexStringToBytes(req.Reserve)
+		if err != nil || len(req.Reserve) != 16 {
+			fail("reserve", "should be 8 bytes in hex")
+		}
+		s.Reserve = b
+	}
+
+	if req.CallbackUrl != "" {
+		if err := checkCallbackUrl(req.CallbackUrl); err != nil {
+			fail("callbackUrl", "should be an absolute http or https url")
+		}
+	}
+
+	return s, errs
+}
+
+func newMessageResponse(result *SubmitResult) *messageResponse {
+	resp := &messageResponse{Sequences: make([]string, 0, len(result.Sequences)), Code: result.Code, Message: result.Message}
+	for _, seq := range result.Sequences {
+		resp.Sequences = append(resp.Sequences, seq.String())
+	}
+	if result.Code == resp_code_ok && len(result.Sequences) > 0 {
+		resp.Sequence = resp.Sequences[0]
+	}
+	return resp
+}
+
+// the status and code of a submit which has no result
+func submitErrorStatus(err error) (int, string) {
+	switch err {
+	case ErrServerStopping:
+		return http.StatusServiceUnavailable, apiCodeStopping
+	case context.DeadlineExceeded, context.Canceled:
+		return http.StatusGatewayTimeout, apiCodeTimeout
+	}
+	if _, ok := err.(*queueError); ok {
+		return http.StatusInternalServerError, apiCodeQueueError
+	}
+	return http.StatusBadRequest, apiCodeInvalidRequest
+}
+
+func writeApiError(w http.ResponseWriter, status int, code, message string, fields []fieldError) {
+	writeApiJson(w, status, apiErrorResponse{apiError{code, message, fields}})
+}
+
+func writeApiJson(w http.ResponseWriter, status int, v interface{}) {
+	res, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(res)
+}
@@ -0,0 +1,289 @@
+package sgip
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+// batchResponse can't be decoded, its results embed the unexported
+// messageResponse
+type batchTestResponse struct {
+	Sent    int
+	Failed  int
+	Results []struct {
+		Index int
+		messageResponse
+		Error *apiError
+	}
+}
+
+func decodeBatchResponse(t *testing.T, w *httptest.ResponseRecorder) *batchTestResponse {
+	var resp batchTestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("status %d, body %s", w.Code, w.Body.String())
+	}
+	return &resp
+}
+
+func TestBatchHandler(t *testing.T) {
+	sgp := newFakeSgp(t)
+	defer sgp.ln.Close()
+
+	// httptest requests come from 192.0.2.1
+	srv, err := NewServer(&SgipConfig{SgpIp: "127.0.0.1", SgpPort: sgp.port(), ReadTimeoutSecond: 1, WriteTimeoutSecond: 1, Logger: seelog.Disabled,
+		TcpClientCount: 1, SubmitWindowSize: 4, SubmitQueueDepth: 2, SpAppIp: "192.0.2.1", CorpId: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.clientWait.Add(1)
+	go srv.tcpClientLoop()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	}()
+
+	message := func(text string) string {
+		return `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"` + text + `"}`
+	}
+	invalid := `{"spNumber":"10655","userNumbers":[],"serviceType":"abc","text":"hello"}`
+	// the fake SGP never answers "drop", more messages than the queue depth
+	// are queued while the others are sent
+	body := `{"messages":[` + strings.Join([]string{message("a"), invalid, message("drop"), message("b"), message("c"), message("d")}, ",") + `]}`
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	srv.batchHandler(w, r)
+
+	resp := decodeBatchResponse(t, w)
+	if resp.Sent != 4 || resp.Failed != 2 || len(resp.Results) != 6 {
+		t.Fatalf("response %s", w.Body.String())
+	}
+
+	seqs := map[string]bool{}
+	for i, result := range resp.Results {
+		if result.Index != i {
+			t.Errorf("result %d has index %d", i, result.Index)
+		}
+		switch i {
+		case 1:
+			if result.Error == nil || result.Error.Code != apiCodeInvalidRequest || result.Code != 0 || result.Sequences != nil {
+				t.Errorf("result %d: %+v, want an invalid_request error", i, result)
+			}
+		case 2:
+			if result.Error != nil || result.Code != SUBMIT_CODE_NO_RESP || result.Sequence != "" {
+				t.Errorf("result %d: %+v, want no submit resp", i, result)
+			}
+		default:
+			if result.Error != nil || result.Code != resp_code_ok || len(result.Sequence) != 24 || seqs[result.Sequence] {
+				t.Errorf("result %d: %+v, want a new sequence", i, result)
+				continue
+			}
+			seqs[result.Sequence] = true
+		}
+	}
+}
+
+func TestBatchHandlerTimeout(t *testing.T) {
+	// the server is not started, so only SubmitQueueDepth messages can be
+	// queued, and they get no results
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDepth: 1, SpAppIp: "192.0.2.1", CorpId: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hello"}`
+	body := `{"messages":[` + valid + "," + valid + `]}`
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest(http.MethodPost, "/v1/messages/batch", strings.NewReader(body)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	srv.batchHandler(w, r)
+
+	resp := decodeBatchResponse(t, w)
+	if resp.Sent != 0 || resp.Failed != 2 {
+		t.Fatalf("response %s", w.Body.String())
+	}
+	for i, result := range resp.Results {
+		if result.Error == nil || result.Error.Code != apiCodeTimeout {
+			t.Errorf("result %d: %+v, want a timeout error", i, result)
+		}
+	}
+	if len(srv.submitChan) != 1 {
+		t.Errorf("%d messages are queued, want 1", len(srv.submitChan))
+	}
+}
+
+func TestMessageSubmitRequest(t *testing.T) {
+	srv := &Server{config: SgipConfig{Logger: seelog.Disabled, CorpId: 12345}}
+	long := strings.Repeat("1", 22)
+
+	tests := []struct {
+		name   string
+		body   string
+		fields []string // the fields of the errors, in order
+	}{
+		{"valid", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hello"}`, nil},
+		{"missing", `{}`, []string{"m.spNumber", "m.serviceType", "m.userNumbers", "m.text"}},
+		{"too long", `{"spNumber":"` + long + `","chargeNumber":"` + long + `","corpId":"123456","serviceType":"abcdefghijk","feeValue":"1234567",
+			"expireTime":"` + long + `","userNumbers":["8613811234567","` + long + `"],"text":"hello"}`,
+			[]string{"m.spNumber", "m.chargeNumber", "m.corpId", "m.serviceType", "m.feeValue", "m.expireTime", "m.userNumbers[1]"}},
+		{"empty user number", `{"spNumber":"10655","userNumbers":[""],"serviceType":"abc","text":"hello"}`, []string{"m.userNumbers[0]"}},
+		{"text and msgContent", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hello","msgContent":"6869"}`, []string{"m.text"}},
+		{"odd hex", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","msgContent":"686"}`, []string{"m.msgContent"}},
+		{"not hex", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","msgContent":"zz"}`, []string{"m.msgContent"}},
+		{"short reserve", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hello","reserve":"0000"}`, []string{"m.reserve"}},
+		{"bad reserve", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hello","reserve":"zz00000000000000"}`, []string{"m.reserve"}},
+		{"out of range", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hello","feeType":256,"priority":-1,"msgCoding":300}`,
+			[]string{"m.feeType", "m.priority", "m.msgCoding"}},
+		{"text not in coding", `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"你好","msgCoding":0}`, []string{"m.text"}},
+	}
+
+	for _, tt := range tests {
+		var req messageRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		_, errs := srv.messageSubmitRequest(&req, "m.")
+		var fields []string
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("%s: error fields %v, want %v", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestMessageSubmitRequestDefaults(t *testing.T) {
+	srv := &Server{config: SgipConfig{Logger: seelog.Disabled, CorpId: 12345}}
+	var req messageRequest
+	json.Unmarshal([]byte(`{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","msgContent":"6869"}`), &req)
+	s, errs := srv.messageSubmitRequest(&req, "")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := SubmitRequest{SpNumber: "10655", UserNumber: []string{"8613811234567"}, CorpId: "12345", ServiceType: "abc", FeeValue: defaultApiFeeValue,
+		GivenValue: defaultApiGivenValue, MtFlag: defaultApiMtFlag, ReportFlag: defaultApiReportFlag, MsgContent: []byte("hi")}
+	if !reflect.DeepEqual(*s, want) {
+		t.Errorf("request %+v, want %+v", *s, want)
+	}
+
+	// the given values replace the defaults, 0 included
+	req = messageRequest{}
+	json.Unmarshal([]byte(`{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"hi","corpId":"54321",
+		"feeValue":"","mtFlag":0,"reportFlag":0,"reserve":"0102030405060708"}`), &req)
+	s, errs = srv.messageSubmitRequest(&req, "")
+	if len(errs) > 0 || s.CorpId != "54321" || s.FeeValue != "" || s.MtFlag != 0 || s.ReportFlag != 0 || !reflect.DeepEqual(s.Reserve, []byte{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("request %+v, errors %v", s, errs)
+	}
+}
+
+func TestMessagesHandler(t *testing.T) {
+	sgp := newFakeSgp(t)
+	defer sgp.ln.Close()
+
+	// httptest requests come from 192.0.2.1
+	newServer := func(clients bool) *Server {
+		srv, err := NewServer(&SgipConfig{SgpIp: "127.0.0.1", SgpPort: sgp.port(), ReadTimeoutSecond: 1, WriteTimeoutSecond: 1, Logger: seelog.Disabled,
+			TcpClientCount: 1, SubmitQueueDepth: 1, SpAppIp: "192.0.2.1", CorpId: 12345})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if clients {
+			srv.clientWait.Add(1)
+			go srv.tcpClientLoop()
+		}
+		return srv
+	}
+	stopServer := func(srv *Server) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	}
+
+	running := newServer(true)
+	defer stopServer(running)
+	// without the tcp client goroutines, the second submit waits for room
+	blocked := newServer(false)
+	defer stopServer(blocked)
+	blocked.submitChan <- submitMessage{responseChan: make(chan submitResult, 1)}
+	stopped := newServer(false)
+	stopServer(stopped)
+
+	message := func(text string) string {
+		return `{"spNumber":"10655","userNumbers":["8613811234567"],"serviceType":"abc","text":"` + text + `"}`
+	}
+	tests := []struct {
+		name   string
+		srv    *Server
+		method string
+		target string
+		remote string
+		body   string
+		status int
+		code   string // the error code, or empty for a submit result
+	}{
+		{"sent", running, http.MethodPost, "/v1/messages", "", message("hello"), http.StatusOK, ""},
+		{"async", running, http.MethodPost, "/v1/messages?async=1", "", message("hello"), http.StatusAccepted, ""},
+		{"forbidden", running, http.MethodPost, "/v1/messages", "10.0.0.1:1234", message("hello"), http.StatusForbidden, apiCodeForbidden},
+		{"method", running, http.MethodGet, "/v1/messages", "", "", http.StatusMethodNotAllowed, apiCodeMethodNotAllowed},
+		{"invalid json", running, http.MethodPost, "/v1/messages", "", `{"spNumber":`, http.StatusBadRequest, apiCodeInvalidJson},
+		{"invalid request", running, http.MethodPost, "/v1/messages", "", `{"spNumber":"10655"}`, http.StatusBadRequest, apiCodeInvalidRequest},
+		{"refused", running, http.MethodPost, "/v1/messages", "", message("refuse"), http.StatusBadGateway, ""},
+		{"stopping", stopped, http.MethodPost, "/v1/messages", "", message("hello"), http.StatusServiceUnavailable, apiCodeStopping},
+		{"timeout", blocked, http.MethodPost, "/v1/messages", "", message("hello"), http.StatusGatewayTimeout, apiCodeTimeout},
+		{"async timeout", blocked, http.MethodPost, "/v1/messages?async=1", "", message("hello"), http.StatusGatewayTimeout, apiCodeTimeout},
+	}
+
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if tt.srv == blocked {
+			ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		}
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)).WithContext(ctx)
+		if tt.remote != "" {
+			r.RemoteAddr = tt.remote
+		}
+		w := httptest.NewRecorder()
+		tt.srv.messagesHandler(w, r)
+		cancel()
+
+		if w.Code != tt.status || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: status %d, body %s, want %d", tt.name, w.Code, w.Body.String(), tt.status)
+			continue
+		}
+		var errResp apiErrorResponse
+		var result messageResponse
+		var j job
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+		json.Unmarshal(w.Body.Bytes(), &result)
+		json.Unmarshal(w.Body.Bytes(), &j)
+		switch {
+		case tt.code != "":
+			if errResp.Error.Code != tt.code {
+				t.Errorf("%s: body %s, want error %s", tt.name, w.Body.String(), tt.code)
+			}
+		case tt.status == http.StatusAccepted:
+			if j.Id == "" || j.State != JOB_STATE_QUEUED || w.Header().Get("Location") != "/v1/messages/"+j.Id {
+				t.Errorf("%s: body %s, location %s", tt.name, w.Body.String(), w.Header().Get("Location"))
+			}
+		case tt.status == http.StatusOK:
+			if result.Code != resp_code_ok || len(result.Sequence) != 24 {
+				t.Errorf("%s: body %s, want a sequence", tt.name, w.Body.String())
+			}
+		default:
+			if result.Code != 88 || result.Sequence != "" {
+				t.Errorf("%s: body %s, want code 88", tt.name, w.Body.String())
+			}
+		}
+	}
+}
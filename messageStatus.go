@@ -0,0 +1,226 @@
+package sgip
+
+import (
+	"fmt"
+	"time"
+)
+
+// MessageStatus is the status of a submitted segment, kept by its submit
+// sequence: the request, the result of the submit resp, and the report of
+// every user number.
+type MessageStatus struct {
+	Sequence   string                         `json:"sequence"`
+	Segment    int                            `json:"segment"` // 1 for the first segment of a long message
+	Segments   int                            `json:"segments"`
+	Request    MessageStatusRequest           `json:"request"`
+	SubmitTime time.Time                      `json:"submitTime"`
+	Result     int                            `json:"result"` // the result of the submit resp, or SUBMIT_CODE_NO_RESP
+	Message    string                         `json:"message"`
+	Reports    map[string]MessageStatusReport `json:"reports"` // by user number
+}
+
+// MessageStatusRequest is the submit sent to the SGP. MsgContent and Reserve
+// are in hex, MsgContent has the UDH for a segment of a long message.
+type MessageStatusRequest struct {
+	SpNumber     string   `json:"spNumber"`
+	ChargeNumber string   `json:"chargeNumber"`
+	UserNumbers  []string `json:"userNumbers"`
+	CorpId       string   `json:"corpId"`
+	ServiceType  string   `json:"serviceType"`
+	FeeType      int      `json:"feeType"`
+	FeeValue     string   `json:"feeValue"`
+	GivenValue   string   `json:"givenValue"`
+	AgentFlag    int      `json:"agentFlag"`
+	MtFlag       int      `json:"mtFlag"`
+	Priority     int      `json:"priority"`
+	ExpireTime   string   `json:"expireTime"`
+	ScheduleTime string   `json:"scheduleTime"`
+	ReportFlag   int      `json:"reportFlag"`
+	Tppid        int      `json:"tppid"`
+	Tpudhi       int      `json:"tpudhi"`
+	MsgCoding    int      `json:"msgCoding"`
+	MsgContent   string   `json:"msgContent"`
+	Reserve      string   `json:"reserve"`
+	CallbackUrl  string   `json:"callbackUrl,omitempty"`
+}
+
+// MessageStatusReport is the last report of a user number.
+type MessageStatusReport struct {
+	State      int       `json:"state"`
+	ErrorCode  int       `json:"errorCode"`
+	ReportTime time.Time `json:"reportTime"`
+}
+
+// the default max count of the statuses kept in memory
+const defaultMessageStatusMaxCount = 100000
+
+// the status of a submit sequence, and when it is removed
+type messageStatusEntry struct {
+	seq    Sequence
+	status MessageStatus
+	expire time.Time
+}
+
+// record the request of the submit seq before it is sent, it is the segment
+// index of segments
+func (srv *Server) addMessageStatus(seq Sequence, input *submitInput, index, segments int) {
+	now := time.Now()
+	e := &messageStatusEntry{
+		seq: seq,
+		status: MessageStatus{
+			Sequence:   seq.String(),
+			Segment:    index + 1,
+			Segments:   segments,
+			Request:    newMessageStatusRequest(input),
+			SubmitTime: now,
+			Result:     SUBMIT_CODE_NO_RESP,
+			Message:    "waiting the submit resp",
+			Reports:    make(map[string]MessageStatusReport),
+		},
+		expire: now.Add(srv.reportRouteTtl()),
+	}
+
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+
+	srv.putMessageStatus(e, now)
+	srv.logMessageStatus(&statusRecord{Op: statusOpAdd, Status: &e.status, Expire: e.expire.Unix()})
+}
+
+// put the status into the store, and remove the expired statuses and the
+// oldest ones over the max count, statusesLock must be held
+func (srv *Server) putMessageStatus(e *messageStatusEntry, now time.Time) {
+	srv.statuses[e.seq] = e
+	srv.statusOrder = append(srv.statusOrder, e)
+
+	max := srv.messageStatusMaxCount()
+	for len(srv.statusOrder) > 0 {
+		first := srv.statusOrder[0]
+		if srv.statuses[first.seq] == first && len(srv.statuses) <= max && !now.After(first.expire) {
+			break
+		}
+		srv.statusOrder[0] = nil
+		srv.statusOrder = srv.statusOrder[1:]
+		if srv.statuses[first.seq] == first {
+			delete(srv.statuses, first.seq)
+		}
+	}
+}
+
+// record the result of the submit seq
+func (srv *Server) finishMessageStatus(seq Sequence, result int, message string) {
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+
+	if e, ok := srv.statuses[seq]; ok {
+		e.status.Result = result
+		e.status.Message = message
+		srv.logMessageStatus(&statusRecord{Op: statusOpResult, Sequence: e.status.Sequence, Result: result, Message: message})
+	}
+}
+
+// record the report of a user number, it returns a copy of the status of
+// the submit seq, or nil if the status is unknown or expired
+func (srv *Server) reportMessageStatus(seq Sequence, userNumber string, state, errorCode byte, reportTime time.Time) *MessageStatus {
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+
+	e, ok := srv.statuses[seq]
+	if !ok || reportTime.After(e.expire) {
+		return nil
+	}
+	r := MessageStatusReport{int(state), int(errorCode), reportTime}
+	e.status.Reports[userNumber] = r
+	srv.logMessageStatus(&statusRecord{Op: statusOpReport, Sequence: e.status.Sequence, UserNumber: userNumber, Report: &r})
+	return e.status.copy()
+}
+
+// a copy of the status of the submit seq, or nil if it is unknown or expired
+func (srv *Server) messageStatus(seq Sequence) *MessageStatus {
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+
+	e, ok := srv.statuses[seq]
+	if !ok || time.Now().After(e.expire) {
+		return nil
+	}
+	return e.status.copy()
+}
+
+func (srv *Server) messageStatusMaxCount() int {
+	if srv.config.MessageStatusMaxCount > 0 {
+		return srv.config.MessageStatusMaxCount
+	}
+	return defaultMessageStatusMaxCount
+}
+
+// the user numbers of the request are never changed, only the reports
+// need to be copied
+func (s *MessageStatus) copy() *MessageStatus {
+	c := *s
+	c.Reports = make(map[string]MessageStatusReport, len(s.Reports))
+	for un, r := range s.Reports {
+		c.Reports[un] = r
+	}
+	return &c
+}
+
+func newMessageStatusRequest(input *submitInput) MessageStatusRequest {
+	return MessageStatusRequest{
+		SpNumber:     input.spNumber,
+		ChargeNumber: input.chargeNumber,
+		UserNumbers:  input.userNumber,
+		CorpId:       input.corpId,
+		ServiceType:  input.serviceType,
+		FeeType:      int(input.feeType),
+		FeeValue:     input.feeValue,
+		GivenValue:   input.givenValue,
+		AgentFlag:    int(input.agentFlag),
+		MtFlag:       int(input.mtFlag),
+		Priority:     int(input.priority),
+		ExpireTime:   input.expireTime,
+		ScheduleTime: input.scheduleTime,
+		ReportFlag:   int(input.reportFlag),
+		Tppid:        int(input.tppid),
+		Tpudhi:       int(input.tpudhi),
+		MsgCoding:    int(input.msgCoding),
+		MsgContent:   bytesToHexString(input.msgContent),
+		Reserve:      bytesToHexString(input.reserve),
+		CallbackUrl:  input.callbackUrl,
+	}
+}
+
+// convert the request back to the submit parameters
+func (r *MessageStatusRequest) input() (submitInput, error) {
+	msgContent, err := hexStringToBytes(r.MsgContent)
+	if err != nil {
+		return submitInput{}, fmt.Errorf("invalid msgContent: %s", err.Error())
+	}
+	reserve, err := hexStringToBytes(r.Reserve)
+	if err != nil {
+		return submitInput{}, fmt.Errorf("invalid reserve: %s", err.Error())
+	}
+
+	return submitInput{
+		spNumber:     r.SpNumber,
+		chargeNumber: r.ChargeNumber,
+		userNumber:   r.UserNumbers,
+		corpId:       r.CorpId,
+		serviceType:  r.ServiceType,
+		feeType:      byte(r.FeeType),
+		feeValue:     r.FeeValue,
+		givenValue:   r.GivenValue,
+		agentFlag:    byte(r.AgentFlag),
+		mtFlag:       byte(r.MtFlag),
+		priority:     byte(r.Priority),
+		expireTime:   r.ExpireTime,
+		scheduleTime: r.ScheduleTime,
+		reportFlag:   byte(r.ReportFlag),
+		tppid:        byte(r.Tppid),
+		tpudhi:       byte(r.Tpudhi),
+		msgCoding:    byte(r.MsgCoding),
+		msgContent:   msgContent,
+		reserve:      reserve,
+		callbackUrl:  r.CallbackUrl,
+	}, nil
+}
@@ -0,0 +1,250 @@
+package sgip
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+// the name of the status log file in SubmitQueueDir
+const messageStatusFile = "status.wal"
+
+// the status log is compacted when it grows over this size, and over twice
+// the size after the last compaction
+const messageStatusCompactSize = 16 << 20
+
+// the operations of the status log records
+const (
+	statusOpAdd    = "add"    // the status of a segment before it is sent
+	statusOpResult = "result" // the result of the submit resp
+	statusOpReport = "report" // the report of a user number
+)
+
+// a record of the status log
+type statusRecord struct {
+	Op         string               `json:"op"`
+	Status     *MessageStatus       `json:"status,omitempty"` // for statusOpAdd
+	Expire     int64                `json:"expire,omitempty"` // for statusOpAdd, in unix seconds
+	Sequence   string               `json:"sequence,omitempty"`
+	Result     int                  `json:"result,omitempty"`
+	Message    string               `json:"message,omitempty"`
+	UserNumber string               `json:"userNumber,omitempty"`
+	Report     *MessageStatusReport `json:"report,omitempty"`
+}
+
+// a log of the message statuses, so the statuses and the callback urls of
+// the submits survive a restart. The records are not synced, a crash may
+// lose the last changes. It is only used with statusesLock held, except
+// the compaction, which writes the live statuses in a goroutine.
+type messageStatusLog struct {
+	path        string
+	logger      seelog.LoggerInterface
+	file        *os.File // nil if the log is closed
+	size        int64
+	compacted   int64 // the size after the last compaction
+	compactSize int64
+	compacting  bool
+	pending     bytes.Buffer // the records written while compacting
+	compactWait sync.WaitGroup
+}
+
+// load the statuses from the log in dir, and compact it
+func (srv *Server) openMessageStatuses(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	l := &messageStatusLog{path: filepath.Join(dir, messageStatusFile), logger: srv.config.Logger, compactSize: messageStatusCompactSize}
+	data, err := ioutil.ReadFile(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+
+	now := time.Now()
+	for len(data) > 0 {
+		var r statusRecord
+		n, err := decodeLogRecord(data, &r)
+		if err != nil {
+			l.logger.Warnf("status log is truncated at a bad record: %s", err.Error())
+			break
+		}
+		data = data[n:]
+		srv.applyStatusRecord(&r, now)
+	}
+
+	srv.statusLog = l
+	data, err = encodeMessageStatuses(srv.liveMessageStatuses())
+	if err != nil {
+		return err
+	}
+	if err = writeFileSync(l.path, data); err != nil {
+		return err
+	}
+	return l.reopen(int64(len(data)))
+}
+
+// apply a record of the log, statusesLock must be held
+func (srv *Server) applyStatusRecord(r *statusRecord, now time.Time) {
+	if r.Op == statusOpAdd {
+		if r.Status == nil {
+			return
+		}
+		seq, err := ParseSequence(r.Status.Sequence)
+		if err != nil {
+			return
+		}
+		if r.Status.Reports == nil {
+			r.Status.Reports = make(map[string]MessageStatusReport)
+		}
+		srv.putMessageStatus(&messageStatusEntry{seq: seq, status: *r.Status, expire: time.Unix(r.Expire, 0)}, now)
+		return
+	}
+
+	seq, err := ParseSequence(r.Sequence)
+	if err != nil {
+		return
+	}
+	e := srv.statuses[seq]
+	if e == nil {
+		return
+	}
+	switch r.Op {
+	case statusOpResult:
+		e.status.Result = r.Result
+		e.status.Message = r.Message
+	case statusOpReport:
+		if r.Report != nil {
+			e.status.Reports[r.UserNumber] = *r.Report
+		}
+	}
+}
+
+// write a record to the status log if there is one, statusesLock must be held
+func (srv *Server) logMessageStatus(r *statusRecord) {
+	l := srv.statusLog
+	if l == nil || l.file == nil {
+		return
+	}
+
+	b, err := encodeLogRecord(r)
+	if err == nil {
+		_, err = l.file.Write(b)
+	}
+	if err != nil {
+		l.logger.Errorf("status log error:%s", err.Error())
+		return
+	}
+	l.size += int64(len(b))
+	if l.compacting {
+		l.pending.Write(b)
+	} else if l.size > l.compactSize && l.size > 2*l.compacted {
+		// the statuses are copied, and written without the lock
+		entries := srv.liveMessageStatuses()
+		for i, e := range entries {
+			entries[i] = &messageStatusEntry{seq: e.seq, status: *e.status.copy(), expire: e.expire}
+		}
+		l.compacting = true
+		l.compactWait.Add(1)
+		go srv.compactMessageStatuses(l, entries)
+	}
+}
+
+// replace the status log with the add records of the entries. The records
+// written meanwhile are appended to the new log.
+func (srv *Server) compactMessageStatuses(l *messageStatusLog, entries []*messageStatusEntry) {
+	defer l.compactWait.Done()
+
+	data, err := encodeMessageStatuses(entries)
+	var tmp string
+	if err == nil {
+		tmp, err = writeTempSync(l.path, data)
+	}
+
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+
+	l.compacting = false
+	pending := l.pending.Bytes()
+	l.pending = bytes.Buffer{}
+	if err == nil && l.file == nil {
+		// the log is closed, the old one has all the records
+		os.Remove(tmp)
+		return
+	}
+	if err == nil {
+		err = appendFile(tmp, pending)
+	}
+	if err == nil {
+		err = renameSync(tmp, l.path)
+	}
+	if err == nil {
+		err = l.reopen(int64(len(data) + len(pending)))
+	}
+	if err != nil {
+		// retry when the log doubles again
+		l.compacted = l.size
+		l.logger.Errorf("status log compact error:%s", err.Error())
+	}
+}
+
+// the statuses in the store, the oldest first, statusesLock must be held
+func (srv *Server) liveMessageStatuses() []*messageStatusEntry {
+	entries := make([]*messageStatusEntry, 0, len(srv.statuses))
+	for _, e := range srv.statusOrder {
+		if srv.statuses[e.seq] == e {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// close the status log, the later changes are kept in memory only
+func (srv *Server) closeMessageStatuses() {
+	srv.statusesLock.Lock()
+	l := srv.statusLog
+	if l != nil && l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	srv.statusesLock.Unlock()
+
+	if l != nil {
+		l.compactWait.Wait()
+	}
+}
+
+// open the compacted log of size bytes to append
+func (l *messageStatusLog) reopen(size int64) error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	l.size = size
+	l.compacted = size
+	return nil
+}
+
+// the add records of the entries
+func encodeMessageStatuses(entries []*messageStatusEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		b, err := encodeLogRecord(&statusRecord{Op: statusOpAdd, Status: &e.status, Expire: e.expire.Unix()})
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	return buf.Bytes(), nil
+}
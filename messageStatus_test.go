@@ -0,0 +1,140 @@
+package sgip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+func newStatusServer(t *testing.T, dir string, max int) *Server {
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDir: dir, MessageStatusMaxCount: max})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestMessageStatusMaxCount(t *testing.T) {
+	srv := newStatusServer(t, "", 3)
+	input := &submitInput{userNumber: []string{"1"}}
+	for i := uint32(1); i <= 5; i++ {
+		srv.addMessageStatus(Sequence{1, 2, i}, input, 0, 1)
+	}
+
+	// the oldest ones are removed first
+	for i := uint32(1); i <= 5; i++ {
+		if got := srv.messageStatus(Sequence{1, 2, i}) != nil; got != (i > 2) {
+			t.Errorf("status %d is kept: %v", i, got)
+		}
+	}
+	if len(srv.statuses) != 3 || len(srv.statusOrder) != 3 {
+		t.Errorf("%d statuses, %d in order, want 3", len(srv.statuses), len(srv.statusOrder))
+	}
+}
+
+func TestMessageStatusExpire(t *testing.T) {
+	srv := newStatusServer(t, "", 0)
+	srv.config.ReportRouteTtlSecond = 1
+	input := &submitInput{userNumber: []string{"1"}}
+	srv.addMessageStatus(Sequence{1, 2, 1}, input, 0, 1)
+	time.Sleep(1100 * time.Millisecond)
+
+	if srv.messageStatus(Sequence{1, 2, 1}) != nil {
+		t.Errorf("expired status is returned")
+	}
+	srv.addMessageStatus(Sequence{1, 2, 2}, input, 0, 1)
+	if len(srv.statuses) != 1 || srv.statuses[Sequence{1, 2, 2}] == nil {
+		t.Errorf("expired status is not removed, %d statuses", len(srv.statuses))
+	}
+}
+
+func TestMessageStatusLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newStatusServer(t, dir, 2)
+	input := &submitInput{userNumber: []string{"8613811234567"}, msgContent: []byte("hi"), callbackUrl: "http://127.0.0.1/campaign/42"}
+	reportTime := time.Now().Truncate(time.Second)
+	srv.addMessageStatus(Sequence{1, 2, 1}, input, 0, 1)
+	srv.addMessageStatus(Sequence{1, 2, 2}, input, 0, 2)
+	srv.addMessageStatus(Sequence{1, 2, 3}, input, 1, 2)
+	srv.finishMessageStatus(Sequence{1, 2, 2}, 0, "success")
+	srv.reportMessageStatus(Sequence{1, 2, 2}, "8613811234567", reportStateOk, 0, reportTime)
+	srv.finishMessageStatus(Sequence{1, 2, 3}, 88, "refused")
+	srv.closeMessageStatuses()
+
+	// a record torn by a crash is dropped
+	f, err := os.OpenFile(filepath.Join(dir, messageStatusFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 100, 1, 2})
+	f.Close()
+
+	srv = newStatusServer(t, dir, 2)
+	if srv.messageStatus(Sequence{1, 2, 1}) != nil {
+		t.Errorf("the status over the max count is restored")
+	}
+	s := srv.messageStatus(Sequence{1, 2, 2})
+	if s == nil {
+		t.Fatal("status is not restored")
+	}
+	r, ok := s.Reports["8613811234567"]
+	if s.Result != 0 || s.Message != "success" || s.Segments != 2 || s.Request.CallbackUrl != input.callbackUrl || !ok || r.State != reportStateOk || !r.ReportTime.Equal(reportTime) {
+		t.Errorf("restored status %+v", s)
+	}
+	if s = srv.messageStatus(Sequence{1, 2, 3}); s == nil || s.Result != 88 || s.Segment != 2 || len(s.Reports) != 0 {
+		t.Errorf("restored status %+v", s)
+	}
+
+	// the log is compacted on start, and the new changes are appended
+	srv.finishMessageStatus(Sequence{1, 2, 3}, 0, "success")
+	srv.closeMessageStatuses()
+	srv = newStatusServer(t, dir, 2)
+	if s = srv.messageStatus(Sequence{1, 2, 3}); s == nil || s.Result != 0 {
+		t.Errorf("status change after restart is lost: %+v", s)
+	}
+}
+
+func TestMessageStatusLogCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newStatusServer(t, dir, 10)
+	srv.statusLog.compactSize = 4096
+	input := &submitInput{userNumber: []string{"8613811234567"}, msgContent: []byte("hi")}
+	for i := uint32(0); i < 1000; i++ {
+		srv.addMessageStatus(Sequence{1, 2, i}, input, 0, 1)
+		srv.finishMessageStatus(Sequence{1, 2, i}, 0, "success")
+		srv.statusLog.compactWait.Wait()
+	}
+
+	// the log is compacted in the background when it doubles
+	srv.statusesLock.Lock()
+	if l := srv.statusLog; l.compacted == 0 || l.size > 2*l.compactSize {
+		t.Errorf("status log size %d, compacted %d", l.size, l.compacted)
+	}
+	srv.statusesLock.Unlock()
+	srv.closeMessageStatuses()
+	if _, err = os.Stat(filepath.Join(dir, messageStatusFile+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary file is left: %v", err)
+	}
+
+	srv = newStatusServer(t, dir, 10)
+	defer srv.closeMessageStatuses()
+	for i := uint32(990); i < 1000; i++ {
+		if s := srv.messageStatus(Sequence{1, 2, i}); s == nil || s.Result != 0 {
+			t.Errorf("status %d after compaction %+v", i, s)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package sgip
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+const (
+	// the delay of the first retry, it doubles after every failure
+	outboxRetryMinDelay = time.Second
+	outboxRetryMaxDelay = 10 * time.Minute
+
+	// how often the outbox looks for the callbacks to retry
+	outboxScanInterval = time.Second
+
+	// the count of goroutines retrying the callbacks
+	outboxWorkerCount = 8
+
+	// the suffix of a file which can't be read as a callback, it is moved to
+	// the dead directory with it
+	outboxCorruptSuffix = ".corrupt"
+
+	// the default max age of a callback
+	defaultCallbackMaxAge = 24 * time.Hour
+)
+
+// a callback kept in the outbox until it succeeds. It is saved as a JSON
+// file in the pending directory, and moved to the dead directory if it still
+// fails after the max age.
+type outboxEntry struct {
+	Id          string    `json:"id"`
+	Method      string    `json:"method"`
+	Url         string    `json:"url"`
+	ContentType string    `json:"contentType,omitempty"`
+	Body        string    `json:"body,omitempty"`
+	Created     time.Time `json:"created"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+
+	next    time.Time // the time of the next attempt
+	sending bool
+}
+
+// a durable outbox of callbacks. A callback is saved before its first
+// attempt, and retried with exponential backoff until it succeeds or gets
+// older than maxAge. The pending callbacks are sent again after restart.
+type outbox struct {
+	pendingDir string
+	deadDir    string
+	maxAge     time.Duration
+	send       func(e *outboxEntry) error
+	logger     seelog.LoggerInterface
+
+	lock    sync.Mutex
+	pending map[string]*outboxEntry
+	counter uint32
+}
+
+// open the outbox in dir, and load the pending callbacks
+func newOutbox(dir string, maxAge time.Duration, logger seelog.LoggerInterface) (*outbox, error) {
+	ob := &outbox{
+		pendingDir: filepath.Join(dir, "pending"),
+		deadDir:    filepath.Join(dir, "dead"),
+		maxAge:     maxAge,
+		logger:     logger,
+		pending:    make(map[string]*outboxEntry),
+	}
+	if ob.maxAge <= 0 {
+		ob.maxAge = defaultCallbackMaxAge
+	}
+	for _, d := range []string{ob.pendingDir, ob.deadDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := ob.readDir(ob.pendingDir, true)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		e.next = now
+		ob.pending[e.Id] = e
+	}
+	if len(entries) > 0 {
+		logger.Infof("outbox loaded %d pending callbacks", len(entries))
+	}
+
+	return ob, nil
+}
+
+// save the callback, then make the first attempt
+func (ob *outbox) add(e *outboxEntry) {
+	e.Id = fmt.Sprintf("%d-%d", time.Now().UnixNano(), atomic.AddUint32(&ob.counter, 1))
+	e.Created = time.Now()
+	if err := ob.save(ob.pendingDir, e); err != nil {
+		// still try it once, like a callback without outbox
+		ob.logger.Errorf("outbox save error:%s", err.Error())
+		if err = ob.send(e); err != nil {
+			ob.logger.Errorf("callback error :%s", err.Error())
+		}
+		return
+	}
+
+	e.sending = true
+	ob.lock.Lock()
+	ob.pending[e.Id] = e
+	ob.lock.Unlock()
+	ob.attempt(e)
+}
+
+// send the callback once, then remove it, schedule the next attempt, or
+// move it to the dead letters
+func (ob *outbox) attempt(e *outboxEntry) {
+	err := ob.send(e)
+
+	ob.lock.Lock()
+	defer ob.lock.Unlock()
+	e.sending = false
+	e.Attempts++
+	if err == nil {
+		delete(ob.pending, e.Id)
+		if err = os.Remove(ob.path(ob.pendingDir, e)); err != nil {
+			ob.logger.Errorf("outbox remove error:%s", err.Error())
+		}
+		return
+	}
+
+	e.LastError = err.Error()
+	if time.Since(e.Created) >= ob.maxAge {
+		ob.logger.Errorf("callback %s is dead after %d attempts:%s", e.Id, e.Attempts, e.LastError)
+		delete(ob.pending, e.Id)
+		if err = ob.save(ob.deadDir, e); err != nil {
+			ob.logger.Errorf("outbox save error:%s", err.Error())
+			return
+		}
+		os.Remove(ob.path(ob.pendingDir, e))
+		return
+	}
+
+	delay := outboxRetryMinDelay << uint(e.Attempts-1)
+	if delay > outboxRetryMaxDelay || delay <= 0 {
+		delay = outboxRetryMaxDelay
+	}
+	e.next = time.Now().Add(delay)
+	ob.logger.Warnf("callback %s failed %d times, retry in %s:%s", e.Id, e.Attempts, delay, e.LastError)
+	if err = ob.save(ob.pendingDir, e); err != nil {
+		ob.logger.Errorf("outbox save error:%s", err.Error())
+	}
+}
+
+// retry the callbacks when they are due, until stop is closed. At most
+// outboxWorkerCount callbacks are retried at a time.
+func (ob *outbox) run(stop chan struct{}) {
+	dueChan := make(chan *outboxEntry)
+	for i := 0; i < outboxWorkerCount; i++ {
+		go func() {
+			for {
+				select {
+				case e := <-dueChan:
+					ob.attempt(e)
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(outboxScanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		now := time.Now()
+		var due []*outboxEntry
+		ob.lock.Lock()
+		for _, e := range ob.pending {
+			if !e.sending && !e.next.After(now) {
+				e.sending = true
+				due = append(due, e)
+			}
+		}
+		ob.lock.Unlock()
+
+		for i, e := range due {
+			select {
+			case dueChan <- e:
+			case <-stop:
+				// the rest are retried after restart
+				ob.lock.Lock()
+				for _, e := range due[i:] {
+					e.sending = false
+				}
+				ob.lock.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// the dead letters, the oldest first
+func (ob *outbox) dead() ([]*outboxEntry, error) {
+	return ob.readDir(ob.deadDir, false)
+}
+
+func (ob *outbox) path(dir string, e *outboxEntry) string {
+	return filepath.Join(dir, e.Id+".json")
+}
+
+func (ob *outbox) save(dir string, e *outboxEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(ob.path(dir, e), b)
+}
+
+// read all the callbacks in dir, the oldest first. A file which can't be
+// read is logged and skipped, with quarantine it is moved to the dead
+// directory with outboxCorruptSuffix.
+func (ob *outbox) readDir(dir string, quarantine bool) ([]*outboxEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*outboxEntry, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		var e outboxEntry
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err == nil {
+			err = json.Unmarshal(b, &e)
+		}
+		if err != nil {
+			ob.logger.Errorf("invalid outbox file %s:%s", filepath.Join(dir, f.Name()), err.Error())
+			if quarantine {
+				ob.quarantine(dir, f.Name())
+			}
+			continue
+		}
+		entries = append(entries, &e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Created.Before(entries[j].Created) })
+
+	return entries, nil
+}
+
+// move the file name in dir to the dead directory, so it is kept for a look
+// but never read as a callback again
+func (ob *outbox) quarantine(dir, name string) {
+	dst := filepath.Join(ob.deadDir, name+outboxCorruptSuffix)
+	if err := os.Rename(filepath.Join(dir, name), dst); err != nil {
+		ob.logger.Errorf("outbox move error:%s", err.Error())
+		return
+	}
+	ob.logger.Warnf("outbox file %s is moved to %s", name, dst)
+}
@@ -0,0 +1,110 @@
+package sgip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+func TestOutboxCorruptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ob, err := newOutbox(dir, time.Hour, seelog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ob.save(ob.pendingDir, &outboxEntry{Id: "1-1", Method: "GET", Url: "http://127.0.0.1/x", Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(ob.pendingDir, "2-2.json"), []byte(`{"id":`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ob, err = newOutbox(dir, time.Hour, seelog.Disabled)
+	if err != nil {
+		t.Fatalf("a corrupt file fails the outbox: %v", err)
+	}
+	if len(ob.pending) != 1 || ob.pending["1-1"] == nil {
+		t.Errorf("%d pending callbacks, want 1-1 only", len(ob.pending))
+	}
+	if _, err = os.Stat(filepath.Join(ob.deadDir, "2-2.json"+outboxCorruptSuffix)); err != nil {
+		t.Errorf("corrupt file is not moved to the dead directory: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(ob.pendingDir, "2-2.json")); !os.IsNotExist(err) {
+		t.Errorf("corrupt file is left in the pending directory")
+	}
+	if dead, err := ob.dead(); err != nil || len(dead) != 0 {
+		t.Errorf("dead letters %d %v, want none", len(dead), err)
+	}
+}
+
+func TestOutboxWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ob, err := newOutbox(dir, time.Hour, seelog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	running, maxRunning, sent := 0, 0, 0
+	ob.send = func(e *outboxEntry) error {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(50 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		sent++
+		lock.Unlock()
+		return nil
+	}
+
+	// the callbacks left by the last run are all due
+	n := outboxWorkerCount * 3
+	for i := 0; i < n; i++ {
+		ob.pending[fmt.Sprint(i)] = &outboxEntry{Id: fmt.Sprint(i), Created: time.Now()}
+	}
+	stop := make(chan struct{})
+	go ob.run(stop)
+	defer close(stop)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		lock.Lock()
+		done := sent == n
+		lock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if sent != n {
+		t.Errorf("%d of %d callbacks are sent", sent, n)
+	}
+	if maxRunning > outboxWorkerCount {
+		t.Errorf("%d callbacks are sent at a time, more than %d", maxRunning, outboxWorkerCount)
+	}
+}
@@ -0,0 +1,126 @@
+package pdu
+
+import "fmt"
+
+// Login types of Bind
+const (
+	LoginSpToSmg  byte = 1
+	LoginSmgToSp  byte = 2
+	LoginSmgToSmg byte = 3
+	LoginSmgToGns byte = 4
+	LoginGnsToSmg byte = 5
+	LoginGnsToGns byte = 6
+	LoginTest     byte = 11
+)
+
+const bindBodyLen = 1 + 16 + 16 + ReserveLen
+
+// Bind is sent first on every connection to authenticate the peer.
+type Bind struct {
+	Header
+	LoginType     byte
+	LoginName     string
+	LoginPassword string
+	Reserve       [ReserveLen]byte
+}
+
+func (m *Bind) MarshalBinary() ([]byte, error) {
+	buf := m.start(CmdBind, bindBodyLen)
+	buf[20] = m.LoginType
+	if err := putString("LoginName", m.LoginName, buf[21:37]); err != nil {
+		return nil, err
+	}
+	if err := putString("LoginPassword", m.LoginPassword, buf[37:53]); err != nil {
+		return nil, err
+	}
+	copy(buf[53:], m.Reserve[:])
+	return buf, nil
+}
+
+func (m *Bind) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdBind, data, bindBodyLen, false); err != nil {
+		return err
+	}
+	m.LoginType = data[20]
+	m.LoginName = getString(data[21:37])
+	m.LoginPassword = getString(data[37:53])
+	copy(m.Reserve[:], data[53:])
+	return nil
+}
+
+func (m *Bind) String() string {
+	return fmt.Sprintf("Bind: %s;Login Type:%02X;Login Name:%s;", m.Header.String(), m.LoginType, m.LoginName)
+}
+
+// BindResp answers a Bind.
+type BindResp struct {
+	Header
+	Result  byte
+	Reserve [ReserveLen]byte
+}
+
+func (m *BindResp) MarshalBinary() ([]byte, error) {
+	return marshalResult(&m.Header, CmdBindResp, m.Result, &m.Reserve), nil
+}
+
+func (m *BindResp) UnmarshalBinary(data []byte) error {
+	return unmarshalResult(&m.Header, CmdBindResp, data, &m.Result, &m.Reserve)
+}
+
+func (m *BindResp) String() string {
+	return fmt.Sprintf("Bind_Resp: %s;result:%02X;", m.Header.String(), m.Result)
+}
+
+// Unbind asks the peer to close the connection.
+type Unbind struct {
+	Header
+}
+
+func (m *Unbind) MarshalBinary() ([]byte, error) {
+	return m.start(CmdUnbind, 0), nil
+}
+
+func (m *Unbind) UnmarshalBinary(data []byte) error {
+	return m.decode(CmdUnbind, data, 0, false)
+}
+
+func (m *Unbind) String() string {
+	return "Unbind: " + m.Header.String()
+}
+
+// UnbindResp answers an Unbind.
+type UnbindResp struct {
+	Header
+}
+
+func (m *UnbindResp) MarshalBinary() ([]byte, error) {
+	return m.start(CmdUnbindResp, 0), nil
+}
+
+func (m *UnbindResp) UnmarshalBinary(data []byte) error {
+	return m.decode(CmdUnbindResp, data, 0, false)
+}
+
+func (m *UnbindResp) String() string {
+	return "Unbind_Resp: " + m.Header.String()
+}
+
+const resultBodyLen = 1 + ReserveLen
+
+// marshalResult encodes the responses which only carry a result and the
+// reserve field.
+func marshalResult(h *Header, cmd uint32, result byte, reserve *[ReserveLen]byte) []byte {
+	buf := h.start(cmd, resultBodyLen)
+	buf[20] = result
+	copy(buf[21:], reserve[:])
+	return buf
+}
+
+func unmarshalResult(h *Header, cmd uint32, data []byte, result *byte, reserve *[ReserveLen]byte) error {
+	if err := h.decode(cmd, data, resultBodyLen, false); err != nil {
+		return err
+	}
+	*result = data[20]
+	copy(reserve[:], data[21:])
+	return nil
+}
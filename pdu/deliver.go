@@ -0,0 +1,76 @@
+package pdu
+
+import "fmt"
+
+const deliverFixedLen = 21 + 21 + 1 + 1 + 1 + 4 + ReserveLen
+
+// Deliver sends a MO message from SMG to SP.
+type Deliver struct {
+	Header
+	UserNumber     string
+	SpNumber       string
+	TpPid          byte
+	TpUdhi         byte
+	MessageCoding  byte
+	MessageContent []byte
+	Reserve        [ReserveLen]byte
+}
+
+func (m *Deliver) MarshalBinary() ([]byte, error) {
+	buf := m.start(CmdDeliver, deliverFixedLen+len(m.MessageContent))
+	w := writer{buf: buf, index: HeaderLen}
+	w.string("UserNumber", m.UserNumber, 21)
+	w.string("SpNumber", m.SpNumber, 21)
+	w.byte(m.TpPid)
+	w.byte(m.TpUdhi)
+	w.byte(m.MessageCoding)
+	w.content(m.MessageContent)
+	w.bytes(m.Reserve[:])
+	if w.err != nil {
+		return nil, w.err
+	}
+	return buf, nil
+}
+
+func (m *Deliver) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdDeliver, data, deliverFixedLen, true); err != nil {
+		return err
+	}
+
+	r := reader{buf: data, index: HeaderLen}
+	m.UserNumber = r.string(21)
+	m.SpNumber = r.string(21)
+	m.TpPid = r.byte()
+	m.TpUdhi = r.byte()
+	m.MessageCoding = r.byte()
+	content, err := r.content(CmdDeliver)
+	if err != nil {
+		return err
+	}
+	m.MessageContent = content
+	copy(m.Reserve[:], r.bytes(ReserveLen))
+	return nil
+}
+
+func (m *Deliver) String() string {
+	return fmt.Sprintf("Deliver: %s;UserNumber:%s;spNumber:%s;Message Coding:%02X;Message Length:%d;", m.Header.String(), m.UserNumber, m.SpNumber, m.MessageCoding, len(m.MessageContent))
+}
+
+// DeliverResp answers a Deliver.
+type DeliverResp struct {
+	Header
+	Result  byte
+	Reserve [ReserveLen]byte
+}
+
+func (m *DeliverResp) MarshalBinary() ([]byte, error) {
+	return marshalResult(&m.Header, CmdDeliverResp, m.Result, &m.Reserve), nil
+}
+
+func (m *DeliverResp) UnmarshalBinary(data []byte) error {
+	return unmarshalResult(&m.Header, CmdDeliverResp, data, &m.Result, &m.Reserve)
+}
+
+func (m *DeliverResp) String() string {
+	return fmt.Sprintf("Deliver_Resp: %s;result:%02X;", m.Header.String(), m.Result)
+}
@@ -0,0 +1,255 @@
+// Package pdu implements encoding and decoding of SGIP 1.2 protocol data units.
+//
+// Every command is a typed struct implementing encoding.BinaryMarshaler and
+// encoding.BinaryUnmarshaler. MarshalBinary fills in the command length and
+// command id of the header, so callers only need to set the sequence number
+// and the body fields.
+package pdu
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+)
+
+// Command ids defined by SGIP 1.2
+const (
+	CmdBind        uint32 = 0x00000001
+	CmdBindResp    uint32 = 0x80000001
+	CmdUnbind      uint32 = 0x00000002
+	CmdUnbindResp  uint32 = 0x80000002
+	CmdSubmit      uint32 = 0x00000003
+	CmdSubmitResp  uint32 = 0x80000003
+	CmdDeliver     uint32 = 0x00000004
+	CmdDeliverResp uint32 = 0x80000004
+	CmdReport      uint32 = 0x00000005
+	CmdReportResp  uint32 = 0x80000005
+	CmdUserrpt     uint32 = 0x00000011
+	CmdUserrptResp uint32 = 0x80000011
+	CmdTrace       uint32 = 0x00001000
+	CmdTraceResp   uint32 = 0x80001000
+)
+
+// HeaderLen is the length of the message head: command length, command id
+// and the 12 bytes sequence number.
+const HeaderLen = 20
+
+// ReserveLen is the length of the reserve field carried by most commands.
+const ReserveLen = 8
+
+// PDU is implemented by every SGIP command.
+type PDU interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+
+	// Head returns the message head of the command.
+	Head() *Header
+}
+
+// Header is the message head shared by all commands.
+type Header struct {
+	Length    uint32
+	CommandID uint32
+	Sequence  [3]uint32
+}
+
+// Head returns h itself, so that every command embedding a Header
+// satisfies the PDU interface.
+func (h *Header) Head() *Header {
+	return h
+}
+
+func (h *Header) String() string {
+	return fmt.Sprintf("length:%08X, type:%08X, seq:%08X %08X %08X", h.Length, h.CommandID, h.Sequence[0], h.Sequence[1], h.Sequence[2])
+}
+
+// MarshalBinary encodes the message head only.
+func (h *Header) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, HeaderLen)
+	h.put(buf)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the message head from the first HeaderLen bytes
+// of data. It does not check the command length against len(data).
+func (h *Header) UnmarshalBinary(data []byte) error {
+	if len(data) < HeaderLen {
+		return &ShortBufferError{Need: HeaderLen, Have: len(data)}
+	}
+
+	h.Length = binary.BigEndian.Uint32(data[0:4])
+	h.CommandID = binary.BigEndian.Uint32(data[4:8])
+	for i := 0; i < 3; i++ {
+		h.Sequence[i] = binary.BigEndian.Uint32(data[8+i*4:])
+	}
+	return nil
+}
+
+func (h *Header) put(buf []byte) {
+	binary.BigEndian.PutUint32(buf[0:4], h.Length)
+	binary.BigEndian.PutUint32(buf[4:8], h.CommandID)
+	for i := 0; i < 3; i++ {
+		binary.BigEndian.PutUint32(buf[8+i*4:], h.Sequence[i])
+	}
+}
+
+// start allocates the buffer of a command with the given body length and
+// writes the message head into it.
+func (h *Header) start(cmd uint32, bodyLen int) []byte {
+	h.Length = uint32(HeaderLen + bodyLen)
+	h.CommandID = cmd
+	buf := make([]byte, HeaderLen+bodyLen)
+	h.put(buf)
+	return buf
+}
+
+// decode checks data against the expected command id and decodes the
+// message head. The body must be exactly bodyLen bytes, or at least bodyLen
+// bytes if variable is true.
+func (h *Header) decode(cmd uint32, data []byte, bodyLen int, variable bool) error {
+	if err := h.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	if h.CommandID != cmd {
+		return &CommandError{Want: cmd, Got: h.CommandID}
+	}
+	if int(h.Length) != len(data) {
+		return &LengthError{CommandID: cmd, Length: int(h.Length), Reason: fmt.Sprintf("but %d bytes given", len(data))}
+	}
+
+	body := len(data) - HeaderLen
+	if variable && body < bodyLen {
+		return &LengthError{CommandID: cmd, Length: len(data), Reason: fmt.Sprintf("want at least %d", HeaderLen+bodyLen)}
+	} else if !variable && body != bodyLen {
+		return &LengthError{CommandID: cmd, Length: len(data), Reason: fmt.Sprintf("want %d", HeaderLen+bodyLen)}
+	}
+	return nil
+}
+
+// New returns an empty command for the command id, or an
+// UnknownCommandError.
+func New(cmd uint32) (PDU, error) {
+	switch cmd {
+	case CmdBind:
+		return new(Bind), nil
+	case CmdBindResp:
+		return new(BindResp), nil
+	case CmdUnbind:
+		return new(Unbind), nil
+	case CmdUnbindResp:
+		return new(UnbindResp), nil
+	case CmdSubmit:
+		return new(Submit), nil
+	case CmdSubmitResp:
+		return new(SubmitResp), nil
+	case CmdDeliver:
+		return new(Deliver), nil
+	case CmdDeliverResp:
+		return new(DeliverResp), nil
+	case CmdReport:
+		return new(Report), nil
+	case CmdReportResp:
+		return new(ReportResp), nil
+	case CmdUserrpt:
+		return new(Userrpt), nil
+	case CmdUserrptResp:
+		return new(UserrptResp), nil
+	case CmdTrace:
+		return new(Trace), nil
+	case CmdTraceResp:
+		return new(TraceResp), nil
+	}
+
+	return nil, UnknownCommandError(cmd)
+}
+
+// Decode parses one complete command. data must hold exactly the number of
+// bytes given by the command length field.
+func Decode(data []byte) (PDU, error) {
+	var h Header
+	if err := h.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	p, err := New(h.CommandID)
+	if err != nil {
+		return nil, err
+	}
+	if err = p.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ShortBufferError is returned when the data is shorter than the fixed
+// part of a command.
+type ShortBufferError struct {
+	Need int
+	Have int
+}
+
+func (e *ShortBufferError) Error() string {
+	return fmt.Sprintf("sgip: short buffer, need %d bytes but have %d", e.Need, e.Have)
+}
+
+// LengthError is returned when a command length does not fit the command.
+type LengthError struct {
+	CommandID uint32
+	Length    int
+	Reason    string
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("sgip: bad length %d for command %08X, %s", e.Length, e.CommandID, e.Reason)
+}
+
+// CommandError is returned when a command is decoded into the wrong type.
+type CommandError struct {
+	Want uint32
+	Got  uint32
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("sgip: command id is %08X, want %08X", e.Got, e.Want)
+}
+
+// UnknownCommandError is returned for a command id not defined by SGIP 1.2.
+type UnknownCommandError uint32
+
+func (e UnknownCommandError) Error() string {
+	return fmt.Sprintf("sgip: unknown command id %08X", uint32(e))
+}
+
+// FieldError is returned by MarshalBinary when a field does not fit its
+// protocol size.
+type FieldError struct {
+	Field  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("sgip: field %s %s", e.Field, e.Reason)
+}
+
+// getString decodes a NUL padded octet string.
+func getString(b []byte) string {
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// putString encodes s into b, padding with NUL. It fails if s is longer
+// than b.
+func putString(field, s string, b []byte) error {
+	if len(s) > len(b) {
+		return &FieldError{Field: field, Reason: fmt.Sprintf("is longer than %d bytes", len(b))}
+	}
+	n := copy(b, s)
+	for ; n < len(b); n++ {
+		b[n] = 0
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package pdu
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []PDU{
+		&Bind{LoginType: LoginSpToSmg, LoginName: "user", LoginPassword: "pass", Reserve: [ReserveLen]byte{1}},
+		&BindResp{Result: 1},
+		&Unbind{},
+		&UnbindResp{},
+		&Submit{
+			SpNumber:       "10655",
+			ChargeNumber:   "8613811234567",
+			UserNumber:     []string{"8613811234567", "8613811234568"},
+			CorpId:         "12345",
+			ServiceType:    "abc",
+			FeeValue:       "0",
+			GivenValue:     "0",
+			ReportFlag:     1,
+			TpUdhi:         1,
+			MessageCoding:  8,
+			MessageContent: []byte{5, 0, 3, 1, 2, 1, 0x4f, 0x60},
+		},
+		&SubmitResp{Result: 88},
+		&Deliver{UserNumber: "8613811234567", SpNumber: "10655", MessageCoding: 15, MessageContent: []byte{0xc4, 0xe3}},
+		&DeliverResp{},
+		&Report{SubmitSequence: [3]uint32{1, 2, 3}, ReportType: 0, UserNumber: "8613811234567", State: 2, ErrorCode: 67},
+		&ReportResp{},
+		&Userrpt{SpNumber: "10655", UserNumber: "8613811234567", UserCondition: 1},
+		&UserrptResp{},
+		&Trace{SubmitSequence: [3]uint32{4, 5, 6}, UserNumber: "8613811234567"},
+		&TraceResp{Nodes: []TraceNode{
+			{Result: 0, NodeId: "30001", ReceiveTime: "261018080000", SendTime: "261018080001"},
+			{Result: 1, NodeId: "30002", ReceiveTime: "261018080001", SendTime: "261018080002"},
+		}},
+	}
+
+	for _, p := range tests {
+		p.Head().Sequence = [3]uint32{3000012345, 1018120000, 7}
+		data, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T marshal: %v", p, err)
+		}
+		if int(p.Head().Length) != len(data) {
+			t.Errorf("%T length is %d, data is %d bytes", p, p.Head().Length, len(data))
+		}
+
+		q, err := Decode(data)
+		if err != nil {
+			t.Fatalf("%T decode: %v", p, err)
+		}
+		if !reflect.DeepEqual(p, q) {
+			t.Errorf("%T round trip:\n got %#v\nwant %#v", p, q, p)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	bind, _ := (&Bind{LoginType: LoginSpToSmg}).MarshalBinary()
+	submit, _ := (&Submit{UserNumber: []string{"1"}, MessageContent: []byte("hello")}).MarshalBinary()
+
+	// the command length says 20 bytes more than the data
+	badLength := append([]byte(nil), bind...)
+	badLength[3] += 20
+
+	// a body shorter than the fixed part with a matching length
+	shortBody := append([]byte(nil), bind[:40]...)
+	shortBody[0], shortBody[1], shortBody[2], shortBody[3] = 0, 0, 0, 40
+
+	unknown := make([]byte, HeaderLen)
+	unknown[3] = HeaderLen
+	unknown[7] = 0x09
+
+	tests := []struct {
+		name string
+		data []byte
+		want interface{}
+	}{
+		{"empty", nil, &ShortBufferError{}},
+		{"short head", bind[:10], &ShortBufferError{}},
+		{"truncated", bind[:len(bind)-1], &LengthError{}},
+		{"bad length", badLength, &LengthError{}},
+		{"short body", shortBody, &LengthError{}},
+		{"truncated content", submit[:len(submit)-2], &LengthError{}},
+		{"unknown command", unknown, UnknownCommandError(0)},
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(tt.data)
+		if err == nil {
+			t.Errorf("%s: no error", tt.name)
+			continue
+		}
+		if reflect.TypeOf(err) != reflect.TypeOf(tt.want) {
+			t.Errorf("%s: error %T %v, want %T", tt.name, err, err, tt.want)
+		}
+	}
+}
+
+func TestUnmarshalWrongCommand(t *testing.T) {
+	data, _ := (&Unbind{}).MarshalBinary()
+	var resp UnbindResp
+	err := resp.UnmarshalBinary(data)
+
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Want != CmdUnbindResp || cmdErr.Got != CmdUnbind {
+		t.Errorf("error %v, want CommandError", err)
+	}
+}
+
+func TestMarshalFieldErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		p     PDU
+		field string
+	}{
+		{"long login name", &Bind{LoginName: strings.Repeat("a", 17)}, "LoginName"},
+		{"no user number", &Submit{}, "UserNumber"},
+		{"too many user numbers", &Submit{UserNumber: make([]string, MaxUserCount+1)}, "UserNumber"},
+		{"long sp number", &Submit{SpNumber: strings.Repeat("1", 22), UserNumber: []string{"1"}}, "SpNumber"},
+		{"long user number", &Trace{UserNumber: strings.Repeat("1", 22)}, "UserNumber"},
+	}
+
+	for _, tt := range tests {
+		_, err := tt.p.MarshalBinary()
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != tt.field {
+			t.Errorf("%s: error %v, want FieldError of %s", tt.name, err, tt.field)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package pdu
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Report types
+const (
+	ReportSubmit  byte = 0 // status of a previous Submit
+	ReportUserRpt byte = 1 // status of a previous Userrpt
+)
+
+// Report states
+const (
+	StateSuccess byte = 0
+	StateWaiting byte = 1
+	StateFailed  byte = 2
+)
+
+const reportBodyLen = 12 + 1 + 21 + 1 + 1 + ReserveLen
+
+// Report tells the SP the final state of a previous Submit.
+type Report struct {
+	Header
+	SubmitSequence [3]uint32
+	ReportType     byte
+	UserNumber     string
+	State          byte
+	ErrorCode      byte
+	Reserve        [ReserveLen]byte
+}
+
+func (m *Report) MarshalBinary() ([]byte, error) {
+	buf := m.start(CmdReport, reportBodyLen)
+	putSequence(m.SubmitSequence, buf[20:32])
+	buf[32] = m.ReportType
+	if err := putString("UserNumber", m.UserNumber, buf[33:54]); err != nil {
+		return nil, err
+	}
+	buf[54] = m.State
+	buf[55] = m.ErrorCode
+	copy(buf[56:], m.Reserve[:])
+	return buf, nil
+}
+
+func (m *Report) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdReport, data, reportBodyLen, false); err != nil {
+		return err
+	}
+	m.SubmitSequence = getSequence(data[20:32])
+	m.ReportType = data[32]
+	m.UserNumber = getString(data[33:54])
+	m.State = data[54]
+	m.ErrorCode = data[55]
+	copy(m.Reserve[:], data[56:])
+	return nil
+}
+
+func (m *Report) String() string {
+	return fmt.Sprintf("Report: %s;Submit Sequence:%08X%08X%08X;Report Type:%02X;User Number:%s;State:%02X;Error Code:%02X;", m.Header.String(),
+		m.SubmitSequence[0], m.SubmitSequence[1], m.SubmitSequence[2], m.ReportType, m.UserNumber, m.State, m.ErrorCode)
+}
+
+// ReportResp answers a Report.
+type ReportResp struct {
+	Header
+	Result  byte
+	Reserve [ReserveLen]byte
+}
+
+func (m *ReportResp) MarshalBinary() ([]byte, error) {
+	return marshalResult(&m.Header, CmdReportResp, m.Result, &m.Reserve), nil
+}
+
+func (m *ReportResp) UnmarshalBinary(data []byte) error {
+	return unmarshalResult(&m.Header, CmdReportResp, data, &m.Result, &m.Reserve)
+}
+
+func (m *ReportResp) String() string {
+	return fmt.Sprintf("Report_Resp: %s;result:%02X;", m.Header.String(), m.Result)
+}
+
+func putSequence(seq [3]uint32, b []byte) {
+	for i := 0; i < 3; i++ {
+		binary.BigEndian.PutUint32(b[i*4:], seq[i])
+	}
+}
+
+func getSequence(b []byte) [3]uint32 {
+	var seq [3]uint32
+	for i := 0; i < 3; i++ {
+		seq[i] = binary.BigEndian.Uint32(b[i*4:])
+	}
+	return seq
+}
@@ -0,0 +1,208 @@
+package pdu
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxUserCount is the largest number of receivers allowed in one Submit.
+const MaxUserCount = 100
+
+// submitFixedLen is the body length of a Submit without user numbers and
+// message content.
+const submitFixedLen = 21 + 21 + 1 + 5 + 10 + 1 + 6 + 6 + 1 + 1 + 1 + 16 + 16 + 1 + 1 + 1 + 1 + 1 + 4 + ReserveLen
+
+// Submit sends a MT message from SP to SMG.
+type Submit struct {
+	Header
+	SpNumber         string
+	ChargeNumber     string
+	UserNumber       []string
+	CorpId           string
+	ServiceType      string
+	FeeType          byte
+	FeeValue         string
+	GivenValue       string
+	AgentFlag        byte
+	MorelatetoMTFlag byte
+	Priority         byte
+	ExpireTime       string
+	ScheduleTime     string
+	ReportFlag       byte
+	TpPid            byte
+	TpUdhi           byte
+	MessageCoding    byte
+	MessageType      byte
+	MessageContent   []byte
+	Reserve          [ReserveLen]byte
+}
+
+func (m *Submit) MarshalBinary() ([]byte, error) {
+	if len(m.UserNumber) == 0 || len(m.UserNumber) > MaxUserCount {
+		return nil, &FieldError{Field: "UserNumber", Reason: fmt.Sprintf("count %d is out of range 1-%d", len(m.UserNumber), MaxUserCount)}
+	}
+
+	buf := m.start(CmdSubmit, submitFixedLen+21*len(m.UserNumber)+len(m.MessageContent))
+	w := writer{buf: buf, index: HeaderLen}
+	w.string("SpNumber", m.SpNumber, 21)
+	w.string("ChargeNumber", m.ChargeNumber, 21)
+	w.byte(byte(len(m.UserNumber)))
+	for _, un := range m.UserNumber {
+		w.string("UserNumber", un, 21)
+	}
+	w.string("CorpId", m.CorpId, 5)
+	w.string("ServiceType", m.ServiceType, 10)
+	w.byte(m.FeeType)
+	w.string("FeeValue", m.FeeValue, 6)
+	w.string("GivenValue", m.GivenValue, 6)
+	w.byte(m.AgentFlag)
+	w.byte(m.MorelatetoMTFlag)
+	w.byte(m.Priority)
+	w.string("ExpireTime", m.ExpireTime, 16)
+	w.string("ScheduleTime", m.ScheduleTime, 16)
+	w.byte(m.ReportFlag)
+	w.byte(m.TpPid)
+	w.byte(m.TpUdhi)
+	w.byte(m.MessageCoding)
+	w.byte(m.MessageType)
+	w.content(m.MessageContent)
+	w.bytes(m.Reserve[:])
+	if w.err != nil {
+		return nil, w.err
+	}
+	return buf, nil
+}
+
+func (m *Submit) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdSubmit, data, submitFixedLen, true); err != nil {
+		return err
+	}
+
+	r := reader{buf: data, index: HeaderLen}
+	m.SpNumber = r.string(21)
+	m.ChargeNumber = r.string(21)
+	count := int(r.byte())
+	if len(data) < HeaderLen+submitFixedLen+21*count {
+		return &LengthError{CommandID: CmdSubmit, Length: len(data), Reason: fmt.Sprintf("too short for %d user numbers", count)}
+	}
+	m.UserNumber = make([]string, count)
+	for i := 0; i < count; i++ {
+		m.UserNumber[i] = r.string(21)
+	}
+	m.CorpId = r.string(5)
+	m.ServiceType = r.string(10)
+	m.FeeType = r.byte()
+	m.FeeValue = r.string(6)
+	m.GivenValue = r.string(6)
+	m.AgentFlag = r.byte()
+	m.MorelatetoMTFlag = r.byte()
+	m.Priority = r.byte()
+	m.ExpireTime = r.string(16)
+	m.ScheduleTime = r.string(16)
+	m.ReportFlag = r.byte()
+	m.TpPid = r.byte()
+	m.TpUdhi = r.byte()
+	m.MessageCoding = r.byte()
+	m.MessageType = r.byte()
+	content, err := r.content(CmdSubmit)
+	if err != nil {
+		return err
+	}
+	m.MessageContent = content
+	copy(m.Reserve[:], r.bytes(ReserveLen))
+	return nil
+}
+
+func (m *Submit) String() string {
+	return fmt.Sprintf("Submit: %s;SpNumber:%s;UserNumber:%v;Message Coding:%02X;Message Length:%d;", m.Header.String(), m.SpNumber, m.UserNumber, m.MessageCoding, len(m.MessageContent))
+}
+
+// SubmitResp answers a Submit.
+type SubmitResp struct {
+	Header
+	Result  byte
+	Reserve [ReserveLen]byte
+}
+
+func (m *SubmitResp) MarshalBinary() ([]byte, error) {
+	return marshalResult(&m.Header, CmdSubmitResp, m.Result, &m.Reserve), nil
+}
+
+func (m *SubmitResp) UnmarshalBinary(data []byte) error {
+	return unmarshalResult(&m.Header, CmdSubmitResp, data, &m.Result, &m.Reserve)
+}
+
+func (m *SubmitResp) String() string {
+	return fmt.Sprintf("Submit_Resp: %s;result:%02X;", m.Header.String(), m.Result)
+}
+
+// writer encodes the body fields one after another. The first error is
+// kept and the following writes are skipped.
+type writer struct {
+	buf   []byte
+	index int
+	err   error
+}
+
+func (w *writer) string(field, s string, size int) {
+	if w.err == nil {
+		w.err = putString(field, s, w.buf[w.index:w.index+size])
+	}
+	w.index += size
+}
+
+func (w *writer) byte(b byte) {
+	w.buf[w.index] = b
+	w.index++
+}
+
+func (w *writer) bytes(b []byte) {
+	copy(w.buf[w.index:], b)
+	w.index += len(b)
+}
+
+// content writes the 4 bytes message length followed by the message.
+func (w *writer) content(b []byte) {
+	binary.BigEndian.PutUint32(w.buf[w.index:], uint32(len(b)))
+	w.index += 4
+	w.bytes(b)
+}
+
+// reader decodes the body fields one after another. The caller must have
+// checked the length of the fixed fields.
+type reader struct {
+	buf   []byte
+	index int
+}
+
+func (r *reader) string(size int) string {
+	s := getString(r.buf[r.index : r.index+size])
+	r.index += size
+	return s
+}
+
+func (r *reader) byte() byte {
+	b := r.buf[r.index]
+	r.index++
+	return b
+}
+
+func (r *reader) bytes(size int) []byte {
+	b := r.buf[r.index : r.index+size]
+	r.index += size
+	return b
+}
+
+// content reads the 4 bytes message length and the message, checking that
+// exactly the reserve field follows it.
+func (r *reader) content(cmd uint32) ([]byte, error) {
+	length := int(binary.BigEndian.Uint32(r.buf[r.index:]))
+	r.index += 4
+	if length < 0 || r.index+length+ReserveLen != len(r.buf) {
+		return nil, &LengthError{CommandID: cmd, Length: len(r.buf), Reason: fmt.Sprintf("message length field is %d", length)}
+	}
+
+	content := make([]byte, length)
+	copy(content, r.bytes(length))
+	return content, nil
+}
@@ -0,0 +1,113 @@
+package pdu
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const traceBodyLen = 12 + 21 + ReserveLen
+
+// Trace asks the gateways for the path of a previous Submit.
+type Trace struct {
+	Header
+	SubmitSequence [3]uint32
+	UserNumber     string
+	Reserve        [ReserveLen]byte
+}
+
+func (m *Trace) MarshalBinary() ([]byte, error) {
+	buf := m.start(CmdTrace, traceBodyLen)
+	putSequence(m.SubmitSequence, buf[20:32])
+	if err := putString("UserNumber", m.UserNumber, buf[32:53]); err != nil {
+		return nil, err
+	}
+	copy(buf[53:], m.Reserve[:])
+	return buf, nil
+}
+
+func (m *Trace) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdTrace, data, traceBodyLen, false); err != nil {
+		return err
+	}
+	m.SubmitSequence = getSequence(data[20:32])
+	m.UserNumber = getString(data[32:53])
+	copy(m.Reserve[:], data[53:])
+	return nil
+}
+
+func (m *Trace) String() string {
+	return fmt.Sprintf("Trace: %s;Submit Sequence:%08X%08X%08X;User Number:%s;", m.Header.String(),
+		m.SubmitSequence[0], m.SubmitSequence[1], m.SubmitSequence[2], m.UserNumber)
+}
+
+// TraceNode is the result reported by one node on the path of a message.
+// ReceiveTime and SendTime use the format yymmddhhmmss.
+type TraceNode struct {
+	Result      byte
+	NodeId      string
+	ReceiveTime string
+	SendTime    string
+	Reserve     [ReserveLen]byte
+}
+
+const traceNodeLen = 1 + 6 + 16 + 16 + ReserveLen
+
+// TraceResp answers a Trace with one entry per node the message passed.
+type TraceResp struct {
+	Header
+	Nodes []TraceNode
+}
+
+func (m *TraceResp) MarshalBinary() ([]byte, error) {
+	if len(m.Nodes) > 255 {
+		return nil, &FieldError{Field: "Count", Reason: fmt.Sprintf("%d is larger than 255", len(m.Nodes))}
+	}
+
+	buf := m.start(CmdTraceResp, 1+traceNodeLen*len(m.Nodes))
+	w := writer{buf: buf, index: HeaderLen}
+	w.byte(byte(len(m.Nodes)))
+	for _, n := range m.Nodes {
+		w.byte(n.Result)
+		w.string("NodeId", n.NodeId, 6)
+		w.string("ReceiveTime", n.ReceiveTime, 16)
+		w.string("SendTime", n.SendTime, 16)
+		w.bytes(n.Reserve[:])
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+	return buf, nil
+}
+
+func (m *TraceResp) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdTraceResp, data, 1, true); err != nil {
+		return err
+	}
+
+	count := int(data[20])
+	if len(data) != HeaderLen+1+traceNodeLen*count {
+		return &LengthError{CommandID: CmdTraceResp, Length: len(data), Reason: fmt.Sprintf("want %d for %d nodes", HeaderLen+1+traceNodeLen*count, count)}
+	}
+
+	r := reader{buf: data, index: HeaderLen + 1}
+	m.Nodes = make([]TraceNode, count)
+	for i := range m.Nodes {
+		n := &m.Nodes[i]
+		n.Result = r.byte()
+		n.NodeId = r.string(6)
+		n.ReceiveTime = r.string(16)
+		n.SendTime = r.string(16)
+		copy(n.Reserve[:], r.bytes(ReserveLen))
+	}
+	return nil
+}
+
+func (m *TraceResp) String() string {
+	buf := bytes.NewBufferString("Trace_Resp: ")
+	buf.WriteString(m.Header.String())
+	buf.WriteString(fmt.Sprintf(";Count:%d;", len(m.Nodes)))
+	for _, n := range m.Nodes {
+		buf.WriteString(fmt.Sprintf("[result:%02X NodeId:%s ReceiveTime:%s SendTime:%s]", n.Result, n.NodeId, n.ReceiveTime, n.SendTime))
+	}
+	return buf.String()
+}
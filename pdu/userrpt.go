@@ -0,0 +1,68 @@
+package pdu
+
+import "fmt"
+
+// User conditions of Userrpt
+const (
+	UserActive    byte = 0
+	UserSuspended byte = 1 // suspended because of arrears
+	UserCancelled byte = 2 // the user has been cancelled
+)
+
+const userrptBodyLen = 21 + 21 + 1 + ReserveLen
+
+// Userrpt tells the SP that the state of a user has changed.
+type Userrpt struct {
+	Header
+	SpNumber      string
+	UserNumber    string
+	UserCondition byte
+	Reserve       [ReserveLen]byte
+}
+
+func (m *Userrpt) MarshalBinary() ([]byte, error) {
+	buf := m.start(CmdUserrpt, userrptBodyLen)
+	if err := putString("SpNumber", m.SpNumber, buf[20:41]); err != nil {
+		return nil, err
+	}
+	if err := putString("UserNumber", m.UserNumber, buf[41:62]); err != nil {
+		return nil, err
+	}
+	buf[62] = m.UserCondition
+	copy(buf[63:], m.Reserve[:])
+	return buf, nil
+}
+
+func (m *Userrpt) UnmarshalBinary(data []byte) error {
+	if err := m.decode(CmdUserrpt, data, userrptBodyLen, false); err != nil {
+		return err
+	}
+	m.SpNumber = getString(data[20:41])
+	m.UserNumber = getString(data[41:62])
+	m.UserCondition = data[62]
+	copy(m.Reserve[:], data[63:])
+	return nil
+}
+
+func (m *Userrpt) String() string {
+	return fmt.Sprintf("Userrpt: %s;SpNumber:%s;UserNumber:%s;User Condition:%02X;", m.Header.String(), m.SpNumber, m.UserNumber, m.UserCondition)
+}
+
+// UserrptResp answers a Userrpt.
+type UserrptResp struct {
+	Header
+	Result  byte
+	Reserve [ReserveLen]byte
+}
+
+func (m *UserrptResp) MarshalBinary() ([]byte, error) {
+	return marshalResult(&m.Header, CmdUserrptResp, m.Result, &m.Reserve), nil
+}
+
+func (m *UserrptResp) UnmarshalBinary(data []byte) error {
+	return unmarshalResult(&m.Header, CmdUserrptResp, data, &m.Result, &m.Reserve)
+}
+
+func (m *UserrptResp) String() string {
+	return fmt.Sprintf("Userrpt_Resp: %s;result:%02X;", m.Header.String(), m.Result)
+}
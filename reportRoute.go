@@ -0,0 +1,35 @@
+package sgip
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// the default time to keep the status and the callback url of a submit, a
+	// report may arrive days later if the phone is off
+	defaultReportRouteTtl = 72 * time.Hour
+
+	// how often the expired statuses are removed
+	reportRouteSweepInterval = time.Minute
+)
+
+func (srv *Server) reportRouteTtl() time.Duration {
+	if srv.config.ReportRouteTtlSecond > 0 {
+		return time.Duration(srv.config.ReportRouteTtlSecond) * time.Second
+	}
+	return defaultReportRouteTtl
+}
+
+// check the callback url given in a submit
+func checkCallbackUrl(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid callbackUrl: %s", err.Error())
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid callbackUrl %q: it should be an absolute http or https url", s)
+	}
+	return nil
+}
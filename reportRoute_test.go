@@ -0,0 +1,67 @@
+package sgip
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+func TestCheckCallbackUrl(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://127.0.0.1/report", true},
+		{"https://example.com/campaign/42?a=1", true},
+		{"ftp://example.com/report", false},
+		{"/report", false},
+		{"http:///report", false},
+		{"http://[::1", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkCallbackUrl(tt.url); (err == nil) != tt.ok {
+			t.Errorf("%q: error %v", tt.url, err)
+		}
+	}
+}
+
+func TestReportRouteAfterRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &eventHandler{make(chan interface{}, 1)}
+	newServer := func() *Server {
+		srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDir: dir, Handler: h})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv
+	}
+
+	seq := Sequence{3000012345, 1018120000, 1}
+	srv := newServer()
+	srv.addMessageStatus(seq, &submitInput{userNumber: []string{"8613811234567"}, callbackUrl: "http://127.0.0.1/campaign/42"}, 0, 1)
+	srv.closeMessageStatuses()
+
+	// the report arrives after a restart
+	srv = newServer()
+	connStatus := CONN_STATUS_BIND
+	m := &report{submitSeq: seq, userNumber: "8613811234567"}
+	m.Process(srv, &connStatus)
+
+	select {
+	case e := <-h.events:
+		if r := e.(*ReportEvent); r.CallbackUrl != "http://127.0.0.1/campaign/42" || r.Status == nil {
+			t.Errorf("report callback url %q, status %v", r.CallbackUrl, r.Status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("report is not handled")
+	}
+}
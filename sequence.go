@@ -1,36 +1,108 @@
 package sgip
 
 import (
+	"fmt"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 )
 
-type msgSequence [3]uint32
+// the default count of counters reserved from SequenceStore at a time
+const defaultSequenceBlockSize = 1000
 
-var sequenceCounter uint32 = 0
-var counterLock sync.Mutex
+// Sequence is the sequence number of SGIP, which has 3 parts: the node number
+// of the sender, the time in MMDDhhmmss format and a counter.
+// The high 8 bits of the counter are the NodeId of the bridge instance.
+type Sequence [3]uint32
 
-func getNewSequence() msgSequence {
-	var seq msgSequence
+// the next sequence. With a SequenceStore it fails if a new block of
+// counters can't be reserved, the reservation is tried again on the next call.
+func (srv *Server) newSequence() (Sequence, error) {
+	var seq Sequence
 
-	areaNo := sgipConfig.AreaPhoneNo
+	areaNo := srv.config.AreaPhoneNo
 	if areaNo < 100 {
 		areaNo *= 10
 	}
 
-	seq[0] = 3*1000000000 + areaNo*100000 + sgipConfig.CorpId
+	seq[0] = 3*1000000000 + areaNo*100000 + srv.config.CorpId
 	t, _ := strconv.ParseUint(time.Now().Format("0102150405"), 10, 32)
 	seq[1] = uint32(t)
-	counterLock.Lock()
-	seq[2] = sequenceCounter
-	sequenceCounter++
-	counterLock.Unlock()
+	srv.counterLock.Lock()
+	defer srv.counterLock.Unlock()
+	if srv.config.SequenceStore != nil && srv.sequenceCounter == srv.sequenceLimit {
+		if err := srv.reserveSequenceBlock(); err != nil {
+			return seq, err
+		}
+	}
+	seq[2] = uint32(srv.config.NodeId)<<24 | srv.sequenceCounter&0xFFFFFF
+	srv.sequenceCounter++
+
+	return seq, nil
+}
+
+// reserve the next block of counters from the store, counterLock must be held.
+// The counters in memory are never used without a reserved block, because
+// they may be used again after restart.
+func (srv *Server) reserveSequenceBlock() error {
+	size := srv.config.SequenceBlockSize
+	if size == 0 {
+		size = defaultSequenceBlockSize
+	}
+
+	start, err := srv.config.SequenceStore.Reserve(size)
+	if err != nil {
+		srv.config.Logger.Errorf("sequence store reserve error:%s", err.Error())
+		return fmt.Errorf("sequence store reserve error: %s", err.Error())
+	}
+
+	srv.sequenceCounter = start
+	srv.sequenceLimit = start + size
+	return nil
+}
+
+// ParseSequence parses a sequence in 24 hex digits, such as
+// "B2D05E003CAE914400000001", or in the decimal form used by the operators,
+// the 3 parts separated by spaces, such as "3000012345 1018120000 1".
+func ParseSequence(s string) (Sequence, error) {
+	var seq Sequence
+
+	if fields := strings.Fields(s); len(fields) == 3 {
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return seq, fmt.Errorf("invalid sequence %q: %s", s, err.Error())
+			}
+			seq[i] = uint32(v)
+		}
+		return seq, nil
+	}
+
+	if len(s) != 24 {
+		return seq, fmt.Errorf("invalid sequence %q: it should be 24 hex digits or 3 decimal numbers", s)
+	}
+	for i := 0; i < 3; i++ {
+		v, err := strconv.ParseUint(s[i*8:i*8+8], 16, 32)
+		if err != nil {
+			return seq, fmt.Errorf("invalid sequence %q: %s", s, err.Error())
+		}
+		seq[i] = uint32(v)
+	}
+
+	return seq, nil
+}
+
+// String returns the sequence in 24 hex digits.
+func (m Sequence) String() string {
+	return fmt.Sprintf("%08X%08X%08X", m[0], m[1], m[2])
+}
 
-	return seq
+// Decimal returns the sequence in the decimal form: node time counter.
+func (m Sequence) Decimal() string {
+	return fmt.Sprintf("%d %010d %d", m[0], m[1], m[2])
 }
 
-func (m msgSequence) fill(buf []byte) {
+func (m Sequence) fill(buf []byte) {
 	if len(buf) != 12 {
 		return
 	}
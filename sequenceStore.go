@@ -0,0 +1,71 @@
+package sgip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SequenceStore persists the counter part of the sequence numbers, so the
+// sequences stay unique after the sgip server restarts.
+type SequenceStore interface {
+	// Reserve reserves count counters and returns the first one. The counters
+	// must never be returned again, even after a restart.
+	Reserve(count uint32) (uint32, error)
+}
+
+// FileSequenceStore keeps the next free counter in a file. The file is
+// rewritten and fsync'd for every reserved block, so a crash loses at most
+// the rest of the current block.
+type FileSequenceStore struct {
+	path string
+	next uint32
+	lock sync.Mutex
+}
+
+// NewFileSequenceStore opens the store in path. A missing file starts the
+// counter from 0.
+func NewFileSequenceStore(path string) (*FileSequenceStore, error) {
+	s := &FileSequenceStore{path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	v, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence file %s: %s", path, err.Error())
+	}
+	s.next = uint32(v)
+
+	return s, nil
+}
+
+// Reserve reserves count counters. It fails when the counters would wrap
+// past 2^32-1, because the wrapped ones have been handed out before.
+func (s *FileSequenceStore) Reserve(count uint32) (uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start := s.next
+	if uint64(start)+uint64(count) > math.MaxUint32 {
+		return 0, fmt.Errorf("sequence file %s: the counters are used up, %d left", s.path, math.MaxUint32-start)
+	}
+	if err := s.save(start + count); err != nil {
+		return 0, err
+	}
+	s.next = start + count
+
+	return start, nil
+}
+
+func (s *FileSequenceStore) save(next uint32) error {
+	return writeFileSync(s.path, []byte(strconv.FormatUint(uint64(next), 10)+"\n"))
+}
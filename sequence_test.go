@@ -0,0 +1,177 @@
+package sgip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cihub/seelog"
+)
+
+// a SequenceStore which fails until ok is set
+type flakySequenceStore struct {
+	ok   bool
+	next uint32
+}
+
+func (s *flakySequenceStore) Reserve(count uint32) (uint32, error) {
+	if !s.ok {
+		return 0, fmt.Errorf("store is down")
+	}
+	start := s.next
+	s.next += count
+	return start, nil
+}
+
+func TestNewSequenceStoreError(t *testing.T) {
+	store := &flakySequenceStore{next: 5000}
+	srv := &Server{config: SgipConfig{Logger: seelog.Disabled, SequenceStore: store, SequenceBlockSize: 2}}
+
+	// no counter is handed out without a reserved block
+	for i := 0; i < 2; i++ {
+		if seq, err := srv.newSequence(); err == nil {
+			t.Fatalf("sequence %s without a reserved block", seq.String())
+		}
+	}
+
+	store.ok = true
+	for _, want := range []uint32{5000, 5001, 5002} {
+		seq, err := srv.newSequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq[2] != want {
+			t.Errorf("counter %d, want %d", seq[2], want)
+		}
+	}
+}
+
+func TestFileSequenceStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sequence")
+
+	// the counters of every block are new, also after the store is reopened
+	seen := map[uint32]bool{}
+	for run := 0; run < 3; run++ {
+		store, err := NewFileSequenceStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, count := range []uint32{1, 10, 100} {
+			start, err := store.Reserve(count)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for c := start; c < start+count; c++ {
+				if seen[c] {
+					t.Fatalf("run %d: counter %d is handed out twice", run, c)
+				}
+				seen[c] = true
+			}
+		}
+	}
+	if len(seen) != 333 {
+		t.Errorf("%d counters, want 333", len(seen))
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		count   uint32
+		start   uint32
+		openErr bool
+		err     bool
+	}{
+		{"missing", "", 10, 0, false, false},
+		{"spaces", " 42 \n", 10, 42, false, false},
+		{"corrupt", "4x2\n", 10, 0, true, false},
+		{"too large", "4294967296\n", 10, 0, true, false},
+		{"last block", "4294967285\n", 10, 4294967285, false, false},
+		{"wrap", "4294967290\n", 10, 0, false, true},
+	}
+	for _, tt := range tests {
+		os.Remove(path)
+		if tt.content != "" {
+			if err = ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		store, err := NewFileSequenceStore(path)
+		if tt.openErr {
+			if err == nil {
+				t.Errorf("%s: no error on open", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: open error %v", tt.name, err)
+			continue
+		}
+		start, err := store.Reserve(tt.count)
+		if (err != nil) != tt.err || (err == nil && start != tt.start) {
+			t.Errorf("%s: Reserve %d, error %v, want %d", tt.name, start, err, tt.start)
+		}
+		if tt.err {
+			// the file is kept, the counters are never handed out again
+			if b, _ := ioutil.ReadFile(path); string(b) != tt.content {
+				t.Errorf("%s: file is %q after the error", tt.name, b)
+			}
+		}
+	}
+}
+
+func TestParseSequence(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Sequence
+		ok   bool
+	}{
+		{"B2D05E003CAE914400000001", Sequence{3000000000, 1018073412, 1}, true},
+		{"b2d05e003cae914400000001", Sequence{3000000000, 1018073412, 1}, true},
+		{"000000000000000000000000", Sequence{}, true},
+		{"FFFFFFFFFFFFFFFFFFFFFFFF", Sequence{0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFF}, true},
+		{"3000012345 1018120000 1", Sequence{3000012345, 1018120000, 1}, true},
+		{"  3000012345  0101000000 4294967295 ", Sequence{3000012345, 101000000, 4294967295}, true},
+		{"", Sequence{}, false},
+		{"B2D05E003CAE91440000001", Sequence{}, false},
+		{"B2D05E003CAE9144000000011", Sequence{}, false},
+		{"G2D05E003CAE914400000001", Sequence{}, false},
+		{"3000012345 1018120000", Sequence{}, false},
+		{"3000012345 1018120000 4294967296", Sequence{}, false},
+		{"3000012345 1018120000 -1", Sequence{}, false},
+		{"3000012345 1018120000 0x1", Sequence{}, false},
+	}
+
+	for _, tt := range tests {
+		seq, err := ParseSequence(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v", tt.s, err)
+			continue
+		}
+		if tt.ok && seq != tt.want {
+			t.Errorf("%q: %v, want %v", tt.s, seq, tt.want)
+		}
+	}
+}
+
+func TestSequenceFormat(t *testing.T) {
+	seq := Sequence{3000012345, 101000000, 7}
+	if s := seq.String(); s != "B2D08E390605234000000007" {
+		t.Errorf("String %s", s)
+	}
+	for _, s := range []string{seq.String(), seq.Decimal()} {
+		if got, err := ParseSequence(s); err != nil || got != seq {
+			t.Errorf("%q parsed as %v %v, want %v", s, got, err, seq)
+		}
+	}
+	if d := seq.Decimal(); d != "3000012345 0101000000 7" {
+		t.Errorf("Decimal %s", d)
+	}
+}
@@ -1,6 +1,13 @@
 package sgip
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/cihub/seelog"
 )
 
@@ -13,36 +20,310 @@ type SgipConfig struct {
 	SpWebListenPort    int // listen for Submit request
 	ReportCallbackUrl  string
 	DeliverCallbackUrl string
+	UserRptCallbackUrl string
 	ReadTimeoutSecond  int
 	WriteTimeoutSecond int
 	SpAppIp            string // it defines which ip can request a submit
+	MaxFrameLength     int    // the max length of a received command, default 4096
 
 	// logger
 	Logger seelog.LoggerInterface
 
+	// the handler of deliver, report and userrpt. If it is nil, they are
+	// called back to DeliverCallbackUrl, ReportCallbackUrl and
+	// UserRptCallbackUrl by HTTP, with
+	// GET in CALLBACK_MODE_GET (default) or JSON POST in CALLBACK_MODE_JSON.
+	Handler      Handler
+	CallbackMode int
+
+	// the secret to sign the HTTP callbacks with HMAC-SHA256, they are not
+	// signed if it is empty
+	CallbackSecret string
+
+	// callback retry parameter. If CallbackOutboxDir is set, the HTTP callbacks
+	// are saved in it and retried until they succeed, or get older than
+	// CallbackMaxAgeSecond (default 86400), then they are kept as dead letters.
+	CallbackOutboxDir    string
+	CallbackMaxAgeSecond int
+
+	// how long the status and the callbackUrl of a submit are kept for its
+	// reports, default 259200. At most MessageStatusMaxCount (default 100000)
+	// statuses are kept, the oldest ones are removed first.
+	ReportRouteTtlSecond  int
+	MessageStatusMaxCount int
+
+	// how long an asynchronous submit is kept after its last change, default
+	// 259200. At most JobMaxCount (default 100000) jobs are kept, the oldest
+	// ones are removed first.
+	JobTtlSecond int
+	JobMaxCount  int
+
 	// goroutine parameter
 	TcpClientCount   int // how many goroutines to send submit to SGP
 	SubmitQueueDepth int
+	SubmitWindowSize int // how many submits wait for the resp on one connection, default 1
+
+	// if SubmitQueueDir is set, the submit queue is kept in a write-ahead log
+	// in it, and the queued submits are sent after restart. The message
+	// statuses are kept in a log in it too.
+	SubmitQueueDir string
 
 	// SGIP parameter
 	AreaPhoneNo   uint32
 	CorpId        uint32
 	LoginUserName string
 	LoginPassword string
+
+	// sequence parameter, the counters are kept in memory if SequenceStore is nil
+	NodeId            uint8 // the id of this instance, instances sharing one CorpId must have different ids
+	SequenceStore     SequenceStore
+	SequenceBlockSize uint32 // how many counters are reserved at a time, default 1000
+
+	// long SMS parameter
+	ConcatRef16Bit      bool // use the UDH IE 0x08 with 16 bits reference instead of IE 0x00
+	ConcatTimeoutSecond int  // how long to wait the missing parts of a long MO message, default 60
 }
 
-var sgipConfig SgipConfig
+// Server is a SGIP bridge of one SP account. It owns the listeners, the
+// submit queue, the sequence generator and the callbacks, so more than one
+// server can run in a process.
+type Server struct {
+	config  SgipConfig
+	handler Handler
+	outbox  *outbox // nil without CallbackOutboxDir
+
+	// the submit queue and the tcp client goroutines
+	submitChan  chan submitMessage
+	clientWait  sync.WaitGroup
+	enqueueWait sync.WaitGroup // the submits being put into submitChan
+	queue       *submitQueue   // nil without SubmitQueueDir
+
+	// the listeners, and the connections from the SGP which are closed when
+	// the server stops
+	tcpListener     net.Listener
+	webServer       *http.Server
+	serverConns     map[net.Conn]bool
+	serverConnsLock sync.Mutex
+
+	// the stop state, stopChan is closed when Stop is called, and stoppedChan
+	// is closed when Stop returns
+	stopping    bool
+	stopLock    sync.RWMutex
+	stopChan    chan struct{}
+	stoppedChan chan struct{}
+	stopCtx     context.Context
+
+	// sequence generator
+	sequenceCounter uint32
+	sequenceLimit   uint32 // the counters before it have been reserved
+	counterLock     sync.Mutex
+
+	// the statuses of the submits, by submit sequence and in the order they
+	// were added
+	statuses     map[Sequence]*messageStatusEntry
+	statusOrder  []*messageStatusEntry
+	statusLog    *messageStatusLog // nil without SubmitQueueDir
+	statusesLock sync.Mutex
+
+	// the asynchronous submits, by id, by submit sequence and in the order
+	// they were added
+	jobs           map[string]*job
+	jobsBySequence map[Sequence]*job
+	jobOrder       []*job
+	jobsSwept      time.Time
+	jobsLock       sync.Mutex
+
+	// long SMS
+	concatRefCounter uint32
+	concatBuffer     map[concatKey]*concatParts
+	concatLock       sync.Mutex
+}
+
+// the server used by Init, Start and Stop
+var defaultServer *Server
+
+// NewServer creates a server with the config, the config is copied.
+func NewServer(config *SgipConfig) (*Server, error) {
+	if config == nil {
+		return nil, fmt.Errorf("config is nil")
+	}
+	if config.Logger == nil {
+		return nil, fmt.Errorf("config Logger is nil")
+	}
+	if config.TcpClientCount <= 0 {
+		return nil, fmt.Errorf("config TcpClientCount should be more than 0")
+	}
+
+	srv := &Server{
+		config:       *config,
+		submitChan:   make(chan submitMessage, config.SubmitQueueDepth),
+		serverConns:  make(map[net.Conn]bool),
+		stopChan:     make(chan struct{}),
+		stoppedChan:  make(chan struct{}),
+		concatBuffer: make(map[concatKey]*concatParts),
+		statuses:     make(map[Sequence]*messageStatusEntry),
+
+		jobs:           make(map[string]*job),
+		jobsBySequence: make(map[Sequence]*job),
+	}
+	srv.handler = config.Handler
+	if srv.handler == nil {
+		h := &HttpCallbackHandler{
+			DeliverCallbackUrl: config.DeliverCallbackUrl,
+			ReportCallbackUrl:  config.ReportCallbackUrl,
+			UserRptCallbackUrl: config.UserRptCallbackUrl,
+			Mode:               config.CallbackMode,
+			Secret:             config.CallbackSecret,
+			Logger:             config.Logger,
+		}
+		if config.CallbackOutboxDir != "" {
+			maxAge := time.Duration(config.CallbackMaxAgeSecond) * time.Second
+			ob, err := newOutbox(config.CallbackOutboxDir, maxAge, config.Logger)
+			if err != nil {
+				return nil, fmt.Errorf("callback outbox error: %s", err.Error())
+			}
+			ob.send = h.send
+			h.outbox = ob
+			srv.outbox = ob
+		}
+		srv.handler = h
+	}
 
-// init the SGIP config para
+	if config.SubmitQueueDir != "" {
+		q, err := newSubmitQueue(config.SubmitQueueDir, config.Logger)
+		if err != nil {
+			return nil, fmt.Errorf("submit queue error: %s", err.Error())
+		}
+		srv.queue = q
+		srv.restoreJobs()
+
+		if err = srv.openMessageStatuses(config.SubmitQueueDir); err != nil {
+			return nil, fmt.Errorf("status log error: %s", err.Error())
+		}
+	}
+	return srv, nil
+}
+
+// init the SGIP config para of the default server, a nil Logger is
+// seelog.Default and TcpClientCount is at least 1. It panics if the callback
+// outbox or the logs in SubmitQueueDir can't be opened, use InitE or
+// NewServer to get the error instead.
 func Init(config *SgipConfig) {
-	sgipConfig = *config
+	if err := InitE(config); err != nil {
+		panic(err.Error())
+	}
 }
 
-// start sgip server.
+// InitE is Init, but it returns the error of NewServer, and the default
+// server is not changed then.
+func InitE(config *SgipConfig) error {
+	c := *config
+	if c.Logger == nil {
+		c.Logger = seelog.Default
+	}
+	if c.TcpClientCount <= 0 {
+		c.Logger.Warnf("config TcpClientCount is %d, 1 is used", c.TcpClientCount)
+		c.TcpClientCount = 1
+	}
+
+	srv, err := NewServer(&c)
+	if err != nil {
+		c.Logger.Criticalf("sgip server init error:%s", err.Error())
+		return err
+	}
+	defaultServer = srv
+	return nil
+}
+
+// start the default sgip server.
 // when this function return, the server is stop
 func Start() {
-	sgipConfig.Logger.Debug("sgip server start")
-	startTcpServer()
-	startWebServer()
-	sgipConfig.Logger.Debug("sgip server stop")
+	defaultServer.Start()
+}
+
+// Stop stops the default sgip server, see Server.Stop.
+func Stop(ctx context.Context) error {
+	return defaultServer.Stop(ctx)
+}
+
+// start sgip server.
+// when this function return, the server is stop
+func (srv *Server) Start() {
+	srv.config.Logger.Debug("sgip server start")
+	if srv.outbox != nil {
+		go srv.outbox.run(srv.stopChan)
+	}
+	srv.startTcpServer()
+	srv.startWebServer()
+	if srv.isStopping() {
+		<-srv.stoppedChan
+	}
+	srv.config.Logger.Debug("sgip server stop")
+}
+
+// Stop stops the sgip server gracefully. It stops accepting HTTP requests
+// and SGP connections, sends the queued submits, then sends Unbind on every
+// connection to the SGP and waits the Unbind_Resp.
+// If ctx is done before that, the rest of the queued submits are rejected,
+// the connections are closed, and ctx.Err() is returned.
+func (srv *Server) Stop(ctx context.Context) error {
+	srv.stopLock.Lock()
+	if srv.stopping {
+		srv.stopLock.Unlock()
+		return nil
+	}
+	srv.stopping = true
+	srv.stopCtx = ctx
+	srv.stopLock.Unlock()
+	close(srv.stopChan)
+	defer close(srv.stoppedChan)
+
+	srv.config.Logger.Debug("sgip server stopping")
+	srv.stopLock.RLock()
+	ln := srv.tcpListener
+	srv.stopLock.RUnlock()
+	if ln != nil {
+		ln.Close()
+	}
+	webErr := make(chan error, 1)
+	go func() {
+		webErr <- srv.stopWebServer(ctx)
+	}()
+
+	// wait the tcp client goroutines to send the queue and unbind
+	clientDone := make(chan struct{})
+	go func() {
+		srv.clientWait.Wait()
+		close(clientDone)
+	}()
+	closeLogs := func() {
+		if srv.queue != nil {
+			srv.queue.close()
+		}
+		srv.closeMessageStatuses()
+	}
+	select {
+	case <-clientDone:
+		closeLogs()
+	case <-ctx.Done():
+		// the tcp client goroutines still running may write the logs, they
+		// are closed after the last of them exits
+		go func() {
+			<-clientDone
+			closeLogs()
+		}()
+	}
+	srv.closeServerConns()
+
+	err := <-webErr
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (srv *Server) isStopping() bool {
+	srv.stopLock.RLock()
+	defer srv.stopLock.RUnlock()
+	return srv.stopping
 }
@@ -0,0 +1,85 @@
+package sgip
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+)
+
+func TestInitDefaults(t *testing.T) {
+	defer func() { defaultServer = nil }()
+
+	Init(&SgipConfig{})
+	if defaultServer == nil || defaultServer.config.Logger == nil || defaultServer.config.TcpClientCount != 1 {
+		t.Fatalf("default server is not initialized with the defaults")
+	}
+
+	// a file where the directory of the log should be
+	dir, err := ioutil.TempDir("", "sgip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := defaultServer
+	bad := &SgipConfig{Logger: seelog.Disabled, TcpClientCount: 2, SubmitQueueDir: file}
+	if err = InitE(bad); err == nil || defaultServer != srv {
+		t.Errorf("InitE error %v, the default server is changed %v", err, defaultServer != srv)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Init doesn't panic without the submit queue log")
+			}
+		}()
+		Init(bad)
+	}()
+}
+
+func TestStopClosesLogsAfterClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a tcp client goroutine is still sending when Stop times out
+	srv.clientWait.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = srv.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Stop error %v, want DeadlineExceeded", err)
+	}
+	id, err := srv.queue.add("", queueSegments(1))
+	if err != nil {
+		t.Fatalf("the queue is closed before the tcp client exits: %v", err)
+	}
+	if err = srv.queue.sent(id, []int{0}); err != nil {
+		t.Errorf("sent error %v", err)
+	}
+
+	srv.clientWait.Done()
+	time.Sleep(100 * time.Millisecond)
+	if _, err = srv.queue.add("", queueSegments(1)); err == nil {
+		t.Errorf("the queue is not closed after the tcp client exits")
+	}
+	srv.statusesLock.Lock()
+	defer srv.statusesLock.Unlock()
+	if srv.statusLog != nil && srv.statusLog.file != nil {
+		t.Errorf("the status log is not closed after the tcp client exits")
+	}
+}
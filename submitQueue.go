@@ -0,0 +1,449 @@
+package sgip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/cihub/seelog"
+)
+
+// the name of the log file in SubmitQueueDir
+const submitQueueFile = "submit.wal"
+
+const (
+	// the log is compacted when it grows over this size, and over twice the
+	// size after the last compaction
+	submitQueueCompactSize = 16 << 20
+
+	// the max size of a record, a corrupted length larger than it ends the log
+	maxQueueRecordSize = 1 << 20
+)
+
+// the operations of the log records
+const (
+	queueOpAdd  = "add"  // the message is accepted
+	queueOpSent = "sent" // the segments are going to be written to the SGP
+	queueOpDone = "done" // all the segments are done
+)
+
+// a write-ahead log of the submit queue. A message is added to the log
+// before it is put into submitChan, its segments are marked before they are
+// written to the SGP, and the message is removed when all the segments are
+// done. After a restart the messages in the log are put into the queue
+// again without the marked segments. A segment marked but not written when
+// the process dies is never sent, so every accepted segment is written to
+// the SGP at most once.
+//
+// The records which must be durable are group committed: the goroutines
+// waiting for a sync share one fsync, which is done without the lock.
+type submitQueue struct {
+	path   string
+	logger seelog.LoggerInterface
+
+	lock   sync.Mutex
+	synced *sync.Cond // signaled when a sync is done
+	file   *os.File   // nil if the queue is closed
+	size   int64
+	// the size after the last compaction, so the log of many waiting
+	// messages is not compacted on every done
+	compacted   int64
+	compactSize int64
+	written     int64 // the bytes written since open, the offset of the records
+	durable     int64 // the bytes of written which have been synced
+	syncing     bool
+	nextId      uint64
+	live        map[uint64]*queueEntry
+}
+
+// a message in the log, sent[i] is true if the segment i has been marked
+type queueEntry struct {
+	Id       uint64                 `json:"id"`
+	JobId    string                 `json:"jobId,omitempty"`
+	Segments []MessageStatusRequest `json:"segments"`
+	Sent     []bool                 `json:"sent"`
+}
+
+// a record of the log, it is framed by its length and CRC-32
+type queueRecord struct {
+	Op      string      `json:"op"`
+	Id      uint64      `json:"id"`
+	Entry   *queueEntry `json:"entry,omitempty"`   // for queueOpAdd
+	Indexes []int       `json:"indexes,omitempty"` // for queueOpSent
+}
+
+// the error of writing the log, the submit is not accepted
+type queueError struct {
+	err error
+}
+
+func (e *queueError) Error() string {
+	return "submit queue error: " + e.err.Error()
+}
+
+// put the submits left in the log by the last run into the queue, the
+// segments which were sent before restart are not sent again
+func (srv *Server) requeueSubmits() {
+	defer srv.enqueueWait.Done()
+	for _, e := range srv.queue.entries() {
+		segments := make([]submitInput, len(e.Segments))
+		var err error
+		for i := range e.Segments {
+			if segments[i], err = e.Segments[i].input(); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			srv.config.Logger.Errorf("submit queue drop message %d:%s", e.Id, err.Error())
+			srv.queue.done(e.Id)
+			if e.JobId != "" {
+				srv.finishJobById(e.JobId, nil, err)
+			}
+			continue
+		}
+
+		rc := make(chan submitResult, 1)
+		msg := submitMessage{para: segments, responseChan: rc, jobId: e.JobId, queueId: e.Id, sent: e.Sent}
+		select {
+		case srv.submitChan <- msg:
+		case <-srv.stopChan:
+			// the rest are kept in the log
+			return
+		}
+
+		go func(e *queueEntry) {
+			result, err := newSubmitResult(<-rc)
+			if err == ErrSubmitQueued {
+				srv.config.Logger.Infof("submit queue message %d is kept in the log", e.Id)
+			} else if err != nil {
+				srv.config.Logger.Warnf("submit queue message %d failed:%s", e.Id, err.Error())
+			} else {
+				srv.config.Logger.Infof("submit queue message %d is sent, sequence %s", e.Id, result.Sequence.String())
+			}
+			if e.JobId != "" {
+				srv.finishJobById(e.JobId, result, err)
+			}
+		}(e)
+	}
+}
+
+// open the log in dir, and replay it. A torn record at the end, left by a
+// crash while it was written, is dropped.
+func newSubmitQueue(dir string, logger seelog.LoggerInterface) (*submitQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &submitQueue{path: filepath.Join(dir, submitQueueFile), logger: logger, compactSize: submitQueueCompactSize, nextId: 1, live: make(map[uint64]*queueEntry)}
+	q.synced = sync.NewCond(&q.lock)
+	data, err := ioutil.ReadFile(q.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for len(data) > 0 {
+		r, n, err := decodeQueueRecord(data)
+		if err != nil {
+			logger.Warnf("submit queue log is truncated at a bad record: %s", err.Error())
+			break
+		}
+		data = data[n:]
+		q.apply(r)
+	}
+
+	// rewrite the log with the live messages only
+	if err = q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// apply a record to the live messages
+func (q *submitQueue) apply(r *queueRecord) {
+	if r.Id >= q.nextId {
+		q.nextId = r.Id + 1
+	}
+	switch r.Op {
+	case queueOpAdd:
+		if r.Entry != nil {
+			q.live[r.Id] = r.Entry
+		}
+	case queueOpSent:
+		if e := q.live[r.Id]; e != nil {
+			e.mark(r.Indexes)
+		}
+	case queueOpDone:
+		delete(q.live, r.Id)
+	}
+}
+
+// add a message to the log, it returns the id of the message
+func (q *submitQueue) add(jobId string, segments []submitInput) (uint64, error) {
+	ids, err := q.addBatch([]submitMessage{{para: segments, jobId: jobId}})
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// add the messages to the log with one write and one sync, it returns the
+// ids of the messages
+func (q *submitQueue) addBatch(msgs []submitMessage) ([]uint64, error) {
+	entries := make([]*queueEntry, len(msgs))
+	for i := range msgs {
+		segments := msgs[i].para
+		e := &queueEntry{JobId: msgs[i].jobId, Segments: make([]MessageStatusRequest, len(segments)), Sent: make([]bool, len(segments))}
+		for j := range segments {
+			e.Segments[j] = newMessageStatusRequest(&segments[j])
+		}
+		entries[i] = e
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	// the messages are live while the records are synced, so a compaction
+	// at that time keeps them
+	ids := make([]uint64, len(entries))
+	records := make([]*queueRecord, len(entries))
+	for i, e := range entries {
+		e.Id = q.nextId
+		q.nextId++
+		q.live[e.Id] = e
+		ids[i] = e.Id
+		records[i] = &queueRecord{Op: queueOpAdd, Id: e.Id, Entry: e}
+	}
+	err := q.append(records...)
+	if err == nil {
+		err = q.sync()
+		if err != nil {
+			// the messages are not accepted, they must not be sent after
+			// restart if the records are on the disk
+			for i := range records {
+				records[i] = &queueRecord{Op: queueOpDone, Id: ids[i]}
+			}
+			q.append(records...)
+		}
+	}
+	if err != nil {
+		for _, id := range ids {
+			delete(q.live, id)
+		}
+		return nil, &queueError{err}
+	}
+	return ids, nil
+}
+
+// mark the segments of the message id before they are written to the SGP
+func (q *submitQueue) sent(id uint64, indexes []int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if e := q.live[id]; e != nil {
+		e.mark(indexes)
+	}
+	err := q.append(&queueRecord{Op: queueOpSent, Id: id, Indexes: indexes})
+	if err == nil {
+		err = q.sync()
+	}
+	if err != nil {
+		return &queueError{err}
+	}
+	return nil
+}
+
+// remove the message id from the log. It is not synced, because a message
+// whose segments are all marked is never sent again.
+func (q *submitQueue) done(id uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil {
+		return
+	}
+	delete(q.live, id)
+	if err := q.append(&queueRecord{Op: queueOpDone, Id: id}); err != nil {
+		q.logger.Errorf("submit queue error:%s", err.Error())
+		return
+	}
+	if q.size > q.compactSize && q.size > 2*q.compacted {
+		if err := q.compact(); err != nil {
+			// retry when the log doubles again
+			q.compacted = q.size
+			q.logger.Errorf("submit queue compact error:%s", err.Error())
+		}
+	}
+}
+
+// mark the segments as sent
+func (e *queueEntry) mark(indexes []int) {
+	for _, i := range indexes {
+		if i >= 0 && i < len(e.Sent) {
+			e.Sent[i] = true
+		}
+	}
+}
+
+// the messages in the log, in the order they were added
+func (q *submitQueue) entries() []*queueEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	entries := make([]*queueEntry, 0, len(q.live))
+	for _, e := range q.live {
+		c := *e
+		c.Sent = append([]bool(nil), e.Sent...)
+		entries = append(entries, &c)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Id < entries[j].Id })
+	return entries
+}
+
+func (q *submitQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file != nil {
+		q.file.Close()
+		q.file = nil
+	}
+}
+
+// write the records in one write, q.lock must be held
+func (q *submitQueue) append(records ...*queueRecord) error {
+	if q.file == nil {
+		return fmt.Errorf("queue is closed")
+	}
+	var buf bytes.Buffer
+	for _, r := range records {
+		b, err := encodeQueueRecord(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	if _, err := q.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	q.size += int64(buf.Len())
+	q.written += int64(buf.Len())
+	return nil
+}
+
+// wait until the records written are synced, q.lock must be held. One of
+// the waiting goroutines syncs the file without the lock, for all the
+// records written before it starts.
+func (q *submitQueue) sync() error {
+	target := q.written
+	for q.durable < target {
+		if q.syncing {
+			q.synced.Wait()
+			continue
+		}
+
+		q.syncing = true
+		f, upto := q.file, q.written
+		q.lock.Unlock()
+		err := f.Sync()
+		q.lock.Lock()
+		q.syncing = false
+		if err == nil && upto > q.durable {
+			q.durable = upto
+		}
+		q.synced.Broadcast()
+
+		// a compaction may have replaced the file while it was synced
+		if err != nil && q.durable < target {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace the log with the records of the live messages, q.lock must be held
+func (q *submitQueue) compact() error {
+	var buf bytes.Buffer
+	for _, e := range q.live {
+		b, err := encodeQueueRecord(&queueRecord{Op: queueOpAdd, Id: e.Id, Entry: e})
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	if err := writeFileSync(q.path, buf.Bytes()); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file = f
+	q.size = int64(buf.Len())
+	q.compacted = q.size
+	// the live records are synced in the new file
+	q.durable = q.written
+	return nil
+}
+
+// a record is the length and the CRC-32 of the JSON, then the JSON
+func encodeQueueRecord(r *queueRecord) ([]byte, error) {
+	return encodeLogRecord(r)
+}
+
+// decode the first record of data, it returns the record and its size
+func decodeQueueRecord(data []byte) (*queueRecord, int, error) {
+	var r queueRecord
+	n, err := decodeLogRecord(data, &r)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &r, n, nil
+}
+
+// frame the JSON of v by its length and CRC-32, the record format of the
+// logs in SubmitQueueDir
+func encodeLogRecord(v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(payload))
+	copy(b[8:], payload)
+	return b, nil
+}
+
+// decode the first record of data into v, it returns the size of the record
+func decodeLogRecord(data []byte, v interface{}) (int, error) {
+	if len(data) < 8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := int(binary.BigEndian.Uint32(data[0:4]))
+	if n > maxQueueRecordSize {
+		return 0, fmt.Errorf("record length %d is too large", n)
+	}
+	if len(data) < 8+n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	payload := data[8 : 8+n]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4:8]) {
+		return 0, fmt.Errorf("record checksum mismatch")
+	}
+
+	if err := json.Unmarshal(payload, v); err != nil {
+		return 0, err
+	}
+	return 8 + n, nil
+}
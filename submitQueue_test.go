@@ -0,0 +1,242 @@
+package sgip
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/cihub/seelog"
+)
+
+func openTestQueue(t *testing.T, dir string) *submitQueue {
+	q, err := newSubmitQueue(dir, seelog.Disabled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func queueSegments(n int) []submitInput {
+	segments := make([]submitInput, n)
+	for i := range segments {
+		segments[i] = submitInput{userNumber: []string{"8613811234567"}, msgContent: []byte{byte(i)}, reserve: make([]byte, 8)}
+	}
+	return segments
+}
+
+func TestSubmitQueueReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir)
+	a, _ := q.add("job-a", queueSegments(3))
+	b, _ := q.add("", queueSegments(1))
+	c, _ := q.add("job-c", queueSegments(2))
+	if err = q.sent(a, []int{0, 2}); err != nil {
+		t.Fatal(err)
+	}
+	q.done(b)
+	q.close()
+
+	tests := []struct {
+		name string
+		tail []byte // written to the end of the log before it is opened
+	}{
+		{"clean", nil},
+		{"torn length", []byte{0, 0}},
+		{"torn record", []byte{0, 0, 0, 100, 1, 2, 3, 4, '{'}},
+		{"bad checksum", []byte{0, 0, 0, 2, 1, 2, 3, 4, '{', '}'}},
+		{"huge length", []byte{0x7f, 0, 0, 0, 1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		if tt.tail != nil {
+			f, err := os.OpenFile(filepath.Join(dir, submitQueueFile), os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(tt.tail)
+			f.Close()
+		}
+
+		q = openTestQueue(t, dir)
+		entries := q.entries()
+		if len(entries) != 2 || entries[0].Id != a || entries[1].Id != c {
+			t.Fatalf("%s: %d entries", tt.name, len(entries))
+		}
+		if entries[0].JobId != "job-a" || !reflect.DeepEqual(entries[0].Sent, []bool{true, false, true}) {
+			t.Errorf("%s: entry a %+v", tt.name, entries[0])
+		}
+		if input, err := entries[1].Segments[1].input(); err != nil || input.msgContent[0] != 1 {
+			t.Errorf("%s: segment of entry c %+v %v", tt.name, input, err)
+		}
+
+		// the ids go on after the replay
+		if id, _ := q.add("", queueSegments(1)); id <= c {
+			t.Errorf("%s: new id %d after %d", tt.name, id, c)
+		} else {
+			q.done(id)
+		}
+		q.close()
+	}
+}
+
+func TestSubmitQueueCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir)
+	kept, _ := q.add("", queueSegments(2))
+	q.sent(kept, []int{1})
+	for i := 0; i < 100; i++ {
+		id, _ := q.add("", queueSegments(1))
+		q.sent(id, []int{0})
+		q.done(id)
+	}
+	size := q.size
+	if err = q.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if q.size >= size/50 {
+		t.Errorf("log is %d bytes after compaction, %d before", q.size, size)
+	}
+
+	// the log is appended after the compaction
+	last, _ := q.add("", queueSegments(1))
+	q.close()
+
+	q = openTestQueue(t, dir)
+	entries := q.entries()
+	if len(entries) != 2 || entries[0].Id != kept || !reflect.DeepEqual(entries[0].Sent, []bool{false, true}) || entries[1].Id != last {
+		t.Errorf("entries after compaction %+v", entries)
+	}
+	q.close()
+}
+
+func TestSubmitQueueGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir)
+	var wait sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			id, err := q.add("", queueSegments(2))
+			if err == nil {
+				err = q.sent(id, []int{0})
+			}
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wait.Wait()
+	if q.durable != q.written || q.syncing {
+		t.Errorf("%d of %d bytes are synced", q.durable, q.written)
+	}
+	q.close()
+
+	q = openTestQueue(t, dir)
+	entries := q.entries()
+	if len(entries) != 50 {
+		t.Fatalf("%d entries, want 50", len(entries))
+	}
+	for _, e := range entries {
+		if !reflect.DeepEqual(e.Sent, []bool{true, false}) {
+			t.Errorf("entry %d sent %v", e.Id, e.Sent)
+		}
+	}
+	q.close()
+
+	// nothing is accepted after close
+	if _, err = q.add("", queueSegments(1)); err == nil {
+		t.Errorf("add after close")
+	}
+}
+
+func TestSubmitQueueCompactWaiting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir)
+	defer q.close()
+	q.compactSize = 4096
+	for i := 0; i < 50; i++ {
+		q.add("", queueSegments(1))
+	}
+
+	// the waiting messages are over the compact size, the log is compacted
+	// when it doubles, not on every done
+	compactions := 0
+	for i := 0; i < 1000; i++ {
+		id, _ := q.add("", queueSegments(1))
+		size := q.size
+		q.done(id)
+		if q.size < size {
+			compactions++
+		}
+	}
+	if compactions == 0 || compactions > 100 {
+		t.Errorf("%d compactions", compactions)
+	}
+	if len(q.entries()) != 50 {
+		t.Errorf("%d entries, want 50", len(q.entries()))
+	}
+}
+
+func TestSubmitQueueAddBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := openTestQueue(t, dir)
+	msgs := make([]submitMessage, 100)
+	for i := range msgs {
+		msgs[i] = submitMessage{para: queueSegments(i%3 + 1)}
+	}
+	msgs[1].jobId = "job-1"
+	written := q.written
+	ids, err := q.addBatch(msgs)
+	if err != nil || len(ids) != len(msgs) {
+		t.Fatalf("%d ids, error %v", len(ids), err)
+	}
+	if q.durable != q.written || q.written == written {
+		t.Errorf("%d of %d bytes are synced", q.durable, q.written)
+	}
+	q.close()
+
+	if _, err = q.addBatch(msgs); err == nil {
+		t.Errorf("addBatch after close")
+	}
+
+	q = openTestQueue(t, dir)
+	defer q.close()
+	entries := q.entries()
+	if len(entries) != len(msgs) {
+		t.Fatalf("%d entries, want %d", len(entries), len(msgs))
+	}
+	for i, e := range entries {
+		if e.Id != ids[i] || len(e.Segments) != i%3+1 || e.JobId != msgs[i].jobId {
+			t.Errorf("entry %d: id %d, %d segments, job %q", i, e.Id, len(e.Segments), e.JobId)
+		}
+	}
+}
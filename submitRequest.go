@@ -0,0 +1,237 @@
+package sgip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/liuben/sgip/pdu"
+)
+
+// ErrServerStopping is returned by Submit when the server is stopping.
+var ErrServerStopping = errors.New("server is stopping")
+
+// ErrSubmitQueued is returned by Submit when the server stops before the
+// message is sent, and the message is kept in the submit queue log to be
+// sent after restart. The submit is accepted, but its result is unknown.
+var ErrSubmitQueued = errors.New("server is stopping, the submit is sent after restart")
+
+// SubmitRequest is a MT message, the fields are the parameters of the SGIP
+// Submit. The content is Text if it is not empty, otherwise MsgContent.
+type SubmitRequest struct {
+	SpNumber     string
+	ChargeNumber string
+	UserNumber   []string
+	CorpId       string
+	ServiceType  string
+	FeeType      byte
+	FeeValue     string
+	GivenValue   string
+	AgentFlag    byte
+	MtFlag       byte
+	Priority     byte
+	ExpireTime   string
+	ScheduleTime string
+	ReportFlag   byte
+	Tppid        byte
+	Tpudhi       byte
+
+	// the coding of MsgContent. With Text, the text is encoded in it, and
+	// MSG_CODING_ASCII means ASCII for pure ASCII text and UCS2 for the others.
+	MsgCoding  byte
+	MsgContent []byte
+	Text       string
+
+	Reserve []byte // 8 bytes, all 0 if it is nil
+
+	// the reports of this message are called back to CallbackUrl instead of
+	// ReportCallbackUrl by the HTTP callback handler
+	CallbackUrl string
+}
+
+// SubmitResult is the result of a submit. A long message is sent in more
+// than one segment, Sequence is the sequence of the first segment, and
+// Sequences has the sequence of every segment accepted by the SGP.
+type SubmitResult struct {
+	Sequence  Sequence
+	Sequences []Sequence
+	Code      int // the result code of the submit resp, or SUBMIT_CODE_NO_RESP
+	Message   string
+}
+
+// SubmitError is returned by Submit when the SGP refuses the submit, or no
+// submit resp is received.
+type SubmitError struct {
+	Code    int
+	Message string
+}
+
+func (e *SubmitError) Error() string {
+	return fmt.Sprintf("submit failed, code %d: %s", e.Code, e.Message)
+}
+
+// Submit sends a message to the SGP, and waits the submit resps of all the
+// segments. It returns a *SubmitError with the result if the submit fails,
+// or ErrSubmitQueued with the result if the message is sent after restart.
+// If ctx is done before the message is sent, the message may still be sent
+// later.
+func (srv *Server) Submit(ctx context.Context, req *SubmitRequest) (*SubmitResult, error) {
+	input, err := req.input()
+	if err != nil {
+		return nil, err
+	}
+
+	sr, err := srv.submit(ctx, input, "")
+	if err != nil {
+		return nil, err
+	}
+	return newSubmitResult(sr)
+}
+
+// convert the result of the tcp client goroutine
+func newSubmitResult(sr submitResult) (*SubmitResult, error) {
+	result := &SubmitResult{Code: sr.result, Message: sr.message, Sequences: make([]Sequence, 0, len(sr.sequences))}
+	for _, s := range sr.sequences {
+		seq, _ := ParseSequence(s)
+		result.Sequences = append(result.Sequences, seq)
+	}
+	if sr.result == SUBMIT_CODE_QUEUED {
+		return result, ErrSubmitQueued
+	}
+	if sr.sequence == "" {
+		return result, &SubmitError{sr.result, sr.message}
+	}
+	result.Sequence = result.Sequences[0]
+
+	return result, nil
+}
+
+// Submit sends a message with the default server, see Server.Submit.
+func Submit(ctx context.Context, req *SubmitRequest) (*SubmitResult, error) {
+	return defaultServer.Submit(ctx, req)
+}
+
+// split the message, put it into the queue, then wait the result
+func (srv *Server) submit(ctx context.Context, input *submitInput, jobId string) (submitResult, error) {
+	rc, err := srv.enqueueInput(ctx, input, jobId)
+	if err != nil {
+		return submitResult{}, err
+	}
+
+	select {
+	case sr := <-rc:
+		return sr, nil
+	case <-ctx.Done():
+		return submitResult{}, ctx.Err()
+	}
+}
+
+// split the message and put it into the queue, the result is sent to the
+// returned channel
+func (srv *Server) enqueueInput(ctx context.Context, input *submitInput, jobId string) (chan submitResult, error) {
+	segments, err := srv.segmentSubmit(input)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := make(chan submitResult, 1)
+	if err = srv.enqueueSubmit(ctx, submitMessage{para: segments, responseChan: rc, jobId: jobId}); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+// check the request, and convert it to the submit parameters
+func (req *SubmitRequest) input() (*submitInput, error) {
+	if req.SpNumber == "" {
+		return nil, fmt.Errorf("no SpNumber")
+	}
+	if len(req.UserNumber) == 0 {
+		return nil, fmt.Errorf("no UserNumber")
+	}
+	if len(req.UserNumber) > pdu.MaxUserCount {
+		return nil, fmt.Errorf("too many UserNumber, at most %d", pdu.MaxUserCount)
+	}
+	if req.CorpId == "" {
+		return nil, fmt.Errorf("no CorpId")
+	}
+	if req.ServiceType == "" {
+		return nil, fmt.Errorf("no ServiceType")
+	}
+
+	// the string fields are truncated to the field length in Submit
+	fields := []struct {
+		name  string
+		value string
+		size  int
+	}{
+		{"SpNumber", req.SpNumber, 21},
+		{"ChargeNumber", req.ChargeNumber, 21},
+		{"CorpId", req.CorpId, 5},
+		{"ServiceType", req.ServiceType, 10},
+		{"FeeValue", req.FeeValue, 6},
+		{"GivenValue", req.GivenValue, 6},
+		{"ExpireTime", req.ExpireTime, 16},
+		{"ScheduleTime", req.ScheduleTime, 16},
+	}
+	for _, f := range fields {
+		if len(f.value) > f.size {
+			return nil, fmt.Errorf("%s %q is longer than %d", f.name, f.value, f.size)
+		}
+	}
+	for _, un := range req.UserNumber {
+		if un == "" || len(un) > 21 {
+			return nil, fmt.Errorf("UserNumber %q is invalid", un)
+		}
+	}
+
+	s := submitInput{
+		spNumber:     req.SpNumber,
+		chargeNumber: req.ChargeNumber,
+		userNumber:   append([]string(nil), req.UserNumber...),
+		corpId:       req.CorpId,
+		serviceType:  req.ServiceType,
+		feeType:      req.FeeType,
+		feeValue:     req.FeeValue,
+		givenValue:   req.GivenValue,
+		agentFlag:    req.AgentFlag,
+		mtFlag:       req.MtFlag,
+		priority:     req.Priority,
+		expireTime:   req.ExpireTime,
+		scheduleTime: req.ScheduleTime,
+		reportFlag:   req.ReportFlag,
+		tppid:        req.Tppid,
+		tpudhi:       req.Tpudhi,
+		msgCoding:    req.MsgCoding,
+		msgContent:   req.MsgContent,
+		reserve:      req.Reserve,
+		callbackUrl:  req.CallbackUrl,
+	}
+
+	if req.Text != "" {
+		msgCoding := int(req.MsgCoding)
+		if req.MsgCoding == MSG_CODING_ASCII {
+			msgCoding = -1
+		}
+		var err error
+		if s.msgCoding, s.msgContent, err = encodeText(req.Text, msgCoding); err != nil {
+			return nil, err
+		}
+	} else if len(req.MsgContent) == 0 {
+		return nil, fmt.Errorf("no Text or MsgContent")
+	}
+
+	if req.CallbackUrl != "" {
+		if err := checkCallbackUrl(req.CallbackUrl); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.reserve == nil {
+		s.reserve = make([]byte, 8)
+	} else if len(s.reserve) != 8 {
+		return nil, fmt.Errorf("Reserve should be 8 bytes")
+	}
+
+	return &s, nil
+}
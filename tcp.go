@@ -2,10 +2,13 @@ package sgip
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"strings"
 	"time"
+
+	"github.com/liuben/sgip/pdu"
 )
 
 const (
@@ -14,172 +17,131 @@ const (
 	CONN_STATUS_CLOSE = 2
 )
 
-type submitMessage struct {
-	para         submitInput
-	responseChan chan string
-}
-
-var submitChan chan submitMessage
-
-func startTcpServer() {
-	go tcpServerLoop()
-
-	submitChan = make(chan submitMessage, sgipConfig.SubmitQueueDepth)
-
-	for i := 0; i < sgipConfig.TcpClientCount; i++ {
-		go tcpClientLoop()
-	}
-}
-
-// tcp server goroutine
-func tcpServerLoop() {
-	port := fmt.Sprintf(":%d", sgipConfig.SpTcpListenPort)
+func (srv *Server) startTcpServer() {
+	port := fmt.Sprintf(":%d", srv.config.SpTcpListenPort)
 	ln, err := net.Listen("tcp4", port)
 	if err != nil {
-		sgipConfig.Logger.Errorf("tcp listen error :%s", err.Error())
+		srv.config.Logger.Errorf("tcp listen error :%s", err.Error())
 		panic(err.Error())
 	}
+	srv.stopLock.Lock()
+	if srv.stopping {
+		srv.stopLock.Unlock()
+		ln.Close()
+		return
+	}
+	srv.tcpListener = ln
+	if srv.queue != nil {
+		// requeueSubmits is waited like the other submits being enqueued
+		srv.enqueueWait.Add(1)
+	}
+	srv.stopLock.Unlock()
+	go srv.tcpServerLoop(ln)
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			sgipConfig.Logger.Errorf("tcp accept error :%s", err.Error())
-			continue
-		}
+	for i := 0; i < srv.config.TcpClientCount; i++ {
+		srv.clientWait.Add(1)
+		go srv.tcpClientLoop()
+	}
 
-		go handleTcpConnection(conn)
+	// the submits left in the log by the last run
+	if srv.queue != nil {
+		go srv.requeueSubmits()
 	}
 }
 
-// tcp client goroutine
-func tcpClientLoop() {
-	defer func() {
-		if errRecover := recover(); errRecover != nil {
-			sgipConfig.Logger.Errorf("recover in tcp client goroutine:%v", errRecover)
-		}
-	}()
-	var buf [512]byte
-	var conn net.Conn
-	connActive := false
-	for {
-		submitMsg := <-submitChan
-		sgipConfig.Logger.Debug("get a submit request in tcp client goroutine")
+// put a submit into the queue, it returns ErrServerStopping if the server is
+// stopping, or ctx.Err() if ctx is done while the queue is full. With the
+// submit queue log, the submit is accepted once it is written to the log.
+// The stop lock is only held to check the state, the tcp client goroutines
+// wait enqueueWait before they drain the queue.
+func (srv *Server) enqueueSubmit(ctx context.Context, msg submitMessage) error {
+	_, err := srv.enqueueSubmits(ctx, []submitMessage{msg})
+	return err
+}
 
-		// get the connection
-		var err error
-		conn, err = getConnection(conn, connActive)
-		if err != nil {
-			sgipConfig.Logger.Errorf("get connecttion error:%s", err.Error())
-			submitMsg.responseChan <- ""
-			connActive = false
-			continue
-		} else {
-			connActive = true
-		}
+// put the submits into the queue in order, they are written to the submit
+// queue log with one sync. It returns how many submits are queued, and the
+// error of the rest, see enqueueSubmit.
+func (srv *Server) enqueueSubmits(ctx context.Context, msgs []submitMessage) (int, error) {
+	srv.stopLock.RLock()
+	if srv.stopping {
+		srv.stopLock.RUnlock()
+		return 0, ErrServerStopping
+	}
+	srv.enqueueWait.Add(1)
+	srv.stopLock.RUnlock()
+	defer srv.enqueueWait.Done()
 
-		// send submit
-		s := newSubmit(&submitMsg.para)
-		var submitLength int
-		submitLength, err = s.Encode(buf[:])
+	if srv.queue != nil {
+		ids, err := srv.queue.addBatch(msgs)
 		if err != nil {
-			sgipConfig.Logger.Errorf("encode sumbit error:%s", err.Error())
-			submitMsg.responseChan <- ""
-			connActive = false
-			continue
+			return 0, err
 		}
-
-		// because the SGP may close the tcp connection, so here may try 2 times.
-		for i := 0; i < 2; i++ {
-			err = sendBindSubmit(conn, buf[:submitLength], 3)
-			if err != nil {
-				conn.Close()
-				sgipConfig.Logger.Debugf("send bind or submit error:%T %s", err, err.Error())
-
-				connActive = false
-				conn, err = getConnection(conn, connActive)
-				if err != nil {
-					break
-				} else {
-					connActive = true
-				}
-			} else {
-				break
-			}
+		for i := range msgs {
+			msgs[i].queueId = ids[i]
 		}
+	}
 
-		if err != nil {
-			sgipConfig.Logger.Errorf("send submit error:%s", err.Error())
-			submitMsg.responseChan <- ""
-			connActive = false
+	for i, msg := range msgs {
+		var err error
+		select {
+		case srv.submitChan <- msg:
 			continue
+		case <-srv.stopChan:
+			err = ErrServerStopping
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
 
-		// submit successful, send back the sequence
-		submitMsg.responseChan <- fmt.Sprintf("%08X%08X%08X", s.sequence[0], s.sequence[1], s.sequence[2])
+		// the caller is told the rest fail, so they are never sent
+		for _, m := range msgs[i:] {
+			if m.queueId != 0 {
+				srv.queue.done(m.queueId)
+			}
+		}
+		return i, err
 	}
+	return len(msgs), nil
 }
 
-func getConnection(conn net.Conn, connActive bool) (net.Conn, error) {
-	var err error
-	if connActive == false {
-		if conn, err = getNewConnection(); err != nil {
-			return nil, err
+// tcp server goroutine
+func (srv *Server) tcpServerLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isStopping() {
+				return
+			}
+			srv.config.Logger.Errorf("tcp accept error :%s", err.Error())
+			continue
 		}
 
-		// send bind
-		var buf [128]byte
-		bindMsg := newBind()
-		bindLen := bindMsg.Encode(buf[:])
-		if err = sendBindSubmit(conn, buf[:bindLen], 1); err != nil {
-			conn.Close()
-			return nil, err
-		}
+		srv.serverConnsLock.Lock()
+		srv.serverConns[conn] = true
+		srv.serverConnsLock.Unlock()
+		go srv.handleTcpConnection(conn)
 	}
-
-	return conn, nil
 }
 
-// send bind or submit, then wait the response
-func sendBindSubmit(conn net.Conn, buf []byte, cmdType byte) error {
-	conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(sgipConfig.WriteTimeoutSecond)))
-	sgipConfig.Logger.Info("tcp client goroutine prepare to send: ", bytesToHexString(buf))
-	_, err := conn.Write(buf)
-	if err != nil {
-		return err
-	} else {
-		conn.SetWriteDeadline(time.Time{})
+// close all the connections from the SGP
+func (srv *Server) closeServerConns() {
+	srv.serverConnsLock.Lock()
+	defer srv.serverConnsLock.Unlock()
+	for conn := range srv.serverConns {
+		conn.Close()
 	}
-
-	sgipConfig.Logger.Debug("send over")
-
-	// receive bind resp or submit resp
-	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(sgipConfig.ReadTimeoutSecond)))
-	var rcvLen int
-	rcvLen, err = conn.Read(buf[:29])
-	if err != nil {
-		return err
-	} else {
-		sgipConfig.Logger.Info("tcp client rcv bytes: ", bytesToHexString(buf[:rcvLen]))
-		conn.SetReadDeadline(time.Time{})
-	}
-
-	if rcvLen != 29 || buf[4] != 0x80 || buf[7] != cmdType || buf[20] != 0 {
-		return fmt.Errorf("invalid response")
-	}
-
-	return nil
 }
 
-func getNewConnection() (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", sgipConfig.SgpIp, sgipConfig.SgpPort))
-	return conn, err
-}
-
-func handleTcpConnection(conn net.Conn) {
-	defer conn.Close()
+func (srv *Server) handleTcpConnection(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		srv.serverConnsLock.Lock()
+		delete(srv.serverConns, conn)
+		srv.serverConnsLock.Unlock()
+	}()
 
 	// check remote ip
-	if checkClientIp(conn.RemoteAddr().String(), sgipConfig.SgpIp) == false {
+	if srv.checkClientIp(conn.RemoteAddr().String(), srv.config.SgpIp) == false {
 		return
 	}
 
@@ -188,88 +150,76 @@ func handleTcpConnection(conn net.Conn) {
 
 	// get buffer
 	reader := bufio.NewReader(conn)
-	var rcvbuf [512]byte
+	rcvbuf := make([]byte, 512)
 	var sndbuf [512]byte
 
 	for {
-		// read command length and command id
-		conn.SetReadDeadline(time.Now().Add(time.Duration(sgipConfig.ReadTimeoutSecond) * time.Second))
-		count, err := reader.Read(rcvbuf[0:8])
-		logBytes(rcvbuf[0:count], "tcp server rcv :")
+		// read a complete command
+		conn.SetReadDeadline(time.Now().Add(time.Duration(srv.config.ReadTimeoutSecond) * time.Second))
+		cmd, err := readFrame(reader, rcvbuf, srv.maxFrameLength())
 		if err != nil {
-			sgipConfig.Logger.Warnf("tcp server receive error :%s", err.Error())
-			return
-		} else if count < 8 {
-			sgipConfig.Logger.Warnf("tcp server receive not enough bytes")
+			srv.config.Logger.Warnf("tcp server receive error :%s", err.Error())
 			return
 		}
 		conn.SetReadDeadline(time.Time{})
-		commandLength := bytesToIntBig(rcvbuf[:4])
-		commandId := bytesToIntBig(rcvbuf[4:8])
-
-		// judge commandId and commandLength
-		rcvPacket := processRcvCommandHead(commandId, commandLength)
-		if rcvPacket == nil {
-			sgipConfig.Logger.Warn("can't parse receive bytes, so server would close connection")
-			return
+		srv.logBytes(cmd, "tcp server rcv :")
+		if cap(cmd) > cap(rcvbuf) {
+			rcvbuf = cmd[:cap(cmd)]
 		}
 
-		// receive the rest command bytes
-		conn.SetReadDeadline(time.Now().Add(time.Duration(sgipConfig.ReadTimeoutSecond) * time.Second))
-		count, err = reader.Read(rcvbuf[8:commandLength])
-		logBytes(rcvbuf[8:8+count], "tcp server rcv :")
+		// a command which can't be decoded closes the connection, it is
+		// never processed
+		p, err := pdu.Decode(cmd)
 		if err != nil {
-			sgipConfig.Logger.Warnf("tcp server receive error :%s", err.Error())
+			srv.config.Logger.Warnf("tcp server packet decode error:%s, so server would close connection", err.Error())
 			return
-		} else if count < commandLength-8 {
-			sgipConfig.Logger.Warnf("tcp server receive not enough bytes")
+		}
+		rcvPacket := newRcvPacket(p)
+		if rcvPacket == nil {
+			srv.config.Logger.Warnf("tcp server rcv unexpected command %08X, so server would close connection", p.Head().CommandID)
 			return
 		}
-		conn.SetReadDeadline(time.Time{})
 
 		// process command
-		if rcvPacket.Decode(rcvbuf[:commandLength]) == false {
-			sgipConfig.Logger.Warnf("tcp server packet decode error")
-		}
-		sgipConfig.Logger.Debugf("tcp server rcv packet:%s", rcvPacket.String())
-		resp := rcvPacket.Process(&connStatus)
+		srv.config.Logger.Debugf("tcp server rcv packet:%s", rcvPacket.String())
+		resp := rcvPacket.Process(srv, &connStatus)
 		if resp == nil {
-			sgipConfig.Logger.Warnf("tcp server packet process error")
+			srv.config.Logger.Warnf("tcp server packet process error")
 			return
 		}
-		sgipConfig.Logger.Debugf("tcp server snd packet:%s", resp.String())
+		srv.config.Logger.Debugf("tcp server snd packet:%s", resp.String())
 
 		// send response
 		sndLen := resp.Encode(sndbuf[:])
 		if sndLen < 0 {
-			sgipConfig.Logger.Errorf("tcp server send buffer overflow")
+			srv.config.Logger.Errorf("tcp server send buffer overflow")
 			return
 		}
 		_, err = conn.Write(sndbuf[:sndLen])
 		if err != nil {
-			sgipConfig.Logger.Warnf("tcp server send error: %s", err.Error())
+			srv.config.Logger.Warnf("tcp server send error: %s", err.Error())
 			return
 		}
-		logBytes(sndbuf[:sndLen], "tcp server snd : ")
+		srv.logBytes(sndbuf[:sndLen], "tcp server snd : ")
 
 		// close after send
 		if connStatus == CONN_STATUS_CLOSE {
-			sgipConfig.Logger.Info("close the connection")
+			srv.config.Logger.Info("close the connection")
 			return
 		}
 	}
 }
 
-func checkClientIp(remoteAdd string, allowIp string) bool {
-	sgipConfig.Logger.Infof("Connected by %s", remoteAdd)
+func (srv *Server) checkClientIp(remoteAdd string, allowIp string) bool {
+	srv.config.Logger.Infof("Connected by %s", remoteAdd)
 	index := strings.Index(remoteAdd, ":")
 	if index <= 0 {
-		sgipConfig.Logger.Infof("Connected not allow by %s", remoteAdd)
+		srv.config.Logger.Infof("Connected not allow by %s", remoteAdd)
 		return false
 	}
 	remoteIp := remoteAdd[:index]
 	if remoteIp != allowIp {
-		sgipConfig.Logger.Infof("Connected not allow by %s", remoteAdd)
+		srv.config.Logger.Infof("Connected not allow by %s", remoteAdd)
 		return false
 	}
 
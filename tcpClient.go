@@ -0,0 +1,587 @@
+package sgip
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liuben/sgip/pdu"
+)
+
+// a submit request, para has more than one segment for a long message
+type submitMessage struct {
+	para         []submitInput
+	responseChan chan submitResult
+	jobId        string // the id of the asynchronous submit, or empty
+	queueId      uint64 // the id in the submit queue log, 0 without the log
+	sent         []bool // the segments written to the SGP before restart, or nil
+}
+
+// the result of a submit, result is the SGIP result code of the submit resp,
+// or SUBMIT_CODE_NO_RESP if no submit resp was received.
+// sequences has the sequence of every segment accepted by the SGP.
+type submitResult struct {
+	sequence  string
+	result    int
+	message   string
+	sequences []string
+}
+
+// a submit message being sent, it collects the results of its segments
+type pendingSubmit struct {
+	srv       *Server
+	msg       submitMessage
+	sequences []Sequence // the sequence of every segment, set when it is encoded
+	lock      sync.Mutex
+	results   []submitResult
+	remaining int
+}
+
+// a submit waiting for its submit resp
+type inflightSubmit struct {
+	pending *pendingSubmit
+	index   int
+	timer   *time.Timer
+}
+
+// a bound connection to the SGP. The tcp client goroutine writes the submits,
+// and a reader goroutine matches the submit resps by sequence.
+type clientConn struct {
+	srv       *Server
+	conn      net.Conn
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	inflight  map[Sequence]*inflightSubmit
+	window    chan struct{} // the window of the tcp client
+	closed    bool
+	closeErr  error         // why the connection is closed
+	unbound   chan struct{} // closed when the unbind resp is received
+}
+
+// the connection used by a tcp client goroutine. window has a slot for every
+// submit in flight, so at most SubmitWindowSize submits wait for the resp.
+type tcpClient struct {
+	srv    *Server
+	cc     *clientConn
+	window chan struct{}
+}
+
+// tcp client goroutine
+func (srv *Server) tcpClientLoop() {
+	defer srv.clientWait.Done()
+	defer func() {
+		if errRecover := recover(); errRecover != nil {
+			srv.config.Logger.Errorf("recover in tcp client goroutine:%v", errRecover)
+		}
+	}()
+	client := tcpClient{srv: srv, window: make(chan struct{}, srv.submitWindowSize())}
+	for {
+		select {
+		case submitMsg := <-srv.submitChan:
+			client.process(submitMsg)
+		case <-srv.stopChan:
+			client.stop()
+			return
+		}
+	}
+}
+
+func (c *tcpClient) process(submitMsg submitMessage) {
+	c.srv.config.Logger.Debug("get a submit request in tcp client goroutine")
+
+	n := len(submitMsg.para)
+	p := &pendingSubmit{srv: c.srv, msg: submitMsg, sequences: make([]Sequence, n), results: make([]submitResult, n), remaining: n}
+	var indexes []int
+	for i := range submitMsg.para {
+		if submitMsg.sent != nil && submitMsg.sent[i] {
+			p.finish(i, submitResult{"", SUBMIT_CODE_NO_RESP, "sent before restart, the submit resp is unknown", nil})
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+
+	// send every segment without waiting the resp of the previous one
+	for _, i := range indexes {
+		c.send(p, i)
+	}
+}
+
+// send the queued submits, then unbind the connection. If the stop is
+// timeout, the rest of the queue is rejected.
+func (c *tcpClient) stop() {
+	// the submits being enqueued either get into the queue or fail now that
+	// stopChan is closed, none of them is left in the queue after the drain
+	c.srv.enqueueWait.Wait()
+	for {
+		var submitMsg submitMessage
+		select {
+		case submitMsg = <-c.srv.submitChan:
+		default:
+			if c.cc != nil && !c.cc.isClosed() {
+				c.cc.unbind(c.window)
+			}
+			return
+		}
+
+		if c.srv.stopCtx.Err() != nil {
+			// the submit is kept in the log, and sent after restart
+			if submitMsg.queueId != 0 {
+				submitMsg.responseChan <- submitResult{"", SUBMIT_CODE_QUEUED, ErrSubmitQueued.Error(), []string{}}
+			} else {
+				submitMsg.responseChan <- submitResult{"", SUBMIT_CODE_NO_RESP, "server is stopping", []string{}}
+			}
+		} else {
+			c.process(submitMsg)
+		}
+	}
+}
+
+func (srv *Server) submitWindowSize() int {
+	if srv.config.SubmitWindowSize > 0 {
+		return srv.config.SubmitWindowSize
+	}
+	return 1
+}
+
+// send one segment of a submit message, the result is set when the submit
+// resp arrives, or the submit fails
+func (c *tcpClient) send(p *pendingSubmit, index int) {
+	// wait for a free slot of the window
+	c.window <- struct{}{}
+
+	s, err := c.srv.newSubmit(&p.msg.para[index])
+	if err != nil {
+		c.srv.config.Logger.Errorf("send submit error:%s", err.Error())
+		<-c.window
+		p.finish(index, submitResult{"", SUBMIT_CODE_NO_RESP, err.Error(), nil})
+		return
+	}
+	buf, err := s.MarshalBinary()
+	if err != nil {
+		c.srv.config.Logger.Errorf("encode sumbit error:%s", err.Error())
+		<-c.window
+		p.finish(index, submitResult{"", SUBMIT_CODE_NO_RESP, err.Error(), nil})
+		return
+	}
+
+	// the reports find the request, the callback url and the job by the sequence
+	seq := Sequence(s.Sequence)
+	p.sequences[index] = seq
+	c.srv.addMessageStatus(seq, &p.msg.para[index], index, len(p.msg.para))
+	if p.msg.jobId != "" {
+		c.srv.addJobSequence(p.msg.jobId, seq)
+	}
+
+	// mark the segment in the log just before it is written, so it is never
+	// sent again after restart. The sync is shared with the other tcp client
+	// goroutines.
+	if p.msg.queueId != 0 {
+		if err = c.srv.queue.sent(p.msg.queueId, []int{index}); err != nil {
+			c.srv.config.Logger.Errorf("send submit error:%s", err.Error())
+			<-c.window
+			p.finish(index, submitResult{"", SUBMIT_CODE_NO_RESP, err.Error(), nil})
+			return
+		}
+	}
+
+	// because the SGP may close the tcp connection, so here may try 2 times.
+	for i := 0; i < 2; i++ {
+		if c.cc == nil || c.cc.isClosed() {
+			var conn net.Conn
+			if conn, err = c.srv.getConnection(nil, false); err != nil {
+				c.srv.config.Logger.Errorf("get connecttion error:%s", err.Error())
+				break
+			}
+			c.cc = newClientConn(c.srv, conn, c.window)
+		}
+
+		if err = c.cc.submit(seq, buf, p, index); err == nil {
+			return
+		}
+		c.srv.config.Logger.Debugf("send submit error:%T %s", err, err.Error())
+		c.cc.close(err)
+	}
+
+	c.srv.config.Logger.Errorf("send submit error:%s", err.Error())
+	<-c.window
+	p.finish(index, submitResult{"", SUBMIT_CODE_NO_RESP, err.Error(), nil})
+}
+
+// set the result of a segment, and send back the result of the message
+// when all the segments are done
+func (p *pendingSubmit) finish(index int, r submitResult) {
+	if seq := p.sequences[index]; seq != (Sequence{}) {
+		p.srv.finishMessageStatus(seq, r.result, r.message)
+	}
+
+	p.lock.Lock()
+	p.results[index] = r
+	p.remaining--
+	remaining := p.remaining
+	p.lock.Unlock()
+	if remaining > 0 {
+		return
+	}
+
+	// the result of the first failed segment is the result of the message
+	result := submitResult{result: resp_code_ok, message: respCodeMessage(resp_code_ok), sequences: make([]string, 0, len(p.results))}
+	failed := false
+	for _, r := range p.results {
+		if r.sequence != "" {
+			result.sequences = append(result.sequences, r.sequence)
+		} else if !failed {
+			failed = true
+			result.result = r.result
+			result.message = r.message
+		}
+	}
+
+	// submit successful, send back the sequence of the first segment
+	if !failed {
+		result.sequence = result.sequences[0]
+	}
+	if p.msg.queueId != 0 {
+		p.srv.queue.done(p.msg.queueId)
+	}
+	p.msg.responseChan <- result
+}
+
+func newClientConn(srv *Server, conn net.Conn, window chan struct{}) *clientConn {
+	cc := &clientConn{srv: srv, conn: conn, inflight: make(map[Sequence]*inflightSubmit), window: window, unbound: make(chan struct{})}
+	go cc.readLoop()
+	return cc
+}
+
+func (cc *clientConn) isClosed() bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	return cc.closed
+}
+
+func (cc *clientConn) close(reason error) {
+	cc.lock.Lock()
+	cc.closed = true
+	if cc.closeErr == nil {
+		cc.closeErr = reason
+	}
+	cc.lock.Unlock()
+	cc.conn.Close()
+}
+
+// register the submit as in flight, then write it
+func (cc *clientConn) submit(seq Sequence, buf []byte, p *pendingSubmit, index int) error {
+	f := &inflightSubmit{pending: p, index: index}
+	cc.lock.Lock()
+	if cc.closed {
+		cc.lock.Unlock()
+		return fmt.Errorf("connection is closed")
+	}
+	cc.inflight[seq] = f
+	f.timer = time.AfterFunc(time.Second*time.Duration(cc.srv.config.ReadTimeoutSecond), func() { cc.timeout(seq, f) })
+	cc.lock.Unlock()
+
+	err := cc.write(buf)
+	if err != nil {
+		// the submit isn't sent, so it can be sent again
+		cc.lock.Lock()
+		if cc.inflight[seq] == f {
+			delete(cc.inflight, seq)
+			f.timer.Stop()
+		} else {
+			// the reader goroutine has already failed it
+			err = nil
+		}
+		cc.lock.Unlock()
+	}
+
+	return err
+}
+
+func (cc *clientConn) write(buf []byte) error {
+	cc.writeLock.Lock()
+	defer cc.writeLock.Unlock()
+
+	cc.conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(cc.srv.config.WriteTimeoutSecond)))
+	cc.srv.config.Logger.Info("tcp client goroutine prepare to send: ", bytesToHexString(buf))
+	if _, err := cc.conn.Write(buf); err != nil {
+		return err
+	}
+	cc.conn.SetWriteDeadline(time.Time{})
+
+	return nil
+}
+
+// no submit resp is received in time, only this submit fails and its slot
+// of the window is freed. The connection is kept, a late submit resp of the
+// sequence is ignored.
+func (cc *clientConn) timeout(seq Sequence, f *inflightSubmit) {
+	cc.lock.Lock()
+	if cc.inflight[seq] != f {
+		cc.lock.Unlock()
+		return
+	}
+	delete(cc.inflight, seq)
+	cc.lock.Unlock()
+
+	cc.srv.config.Logger.Warnf("submit resp timeout, seq:%s", seq.String())
+	<-cc.window
+	f.pending.finish(f.index, submitResult{"", SUBMIT_CODE_NO_RESP, "submit resp timeout", nil})
+}
+
+// wait the submits in flight, then send unbind and wait the unbind resp
+func (cc *clientConn) unbind(window chan struct{}) {
+	defer cc.close(fmt.Errorf("server is stopping"))
+
+	// take all the slots of the window, so no submit is in flight
+	for i := 0; i < cap(window); i++ {
+		select {
+		case window <- struct{}{}:
+		case <-cc.srv.stopCtx.Done():
+			return
+		}
+	}
+	if cc.isClosed() {
+		return
+	}
+
+	seq, err := cc.srv.newSequence()
+	if err != nil {
+		cc.srv.config.Logger.Warnf("send unbind error:%s", err.Error())
+		return
+	}
+	var ub pdu.Unbind
+	ub.Sequence = [3]uint32(seq)
+	buf, _ := ub.MarshalBinary()
+	if err := cc.write(buf); err != nil {
+		cc.srv.config.Logger.Warnf("send unbind error:%s", err.Error())
+		return
+	}
+
+	select {
+	case <-cc.unbound:
+		cc.srv.config.Logger.Debug("tcp client connection is unbound")
+	case <-cc.srv.stopCtx.Done():
+	case <-time.After(time.Second * time.Duration(cc.srv.config.ReadTimeoutSecond)):
+		cc.srv.config.Logger.Warn("unbind resp timeout")
+	}
+}
+
+// remove a submit from the in flight list, it returns nil if the submit
+// has been removed
+func (cc *clientConn) take(seq Sequence) *inflightSubmit {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	f := cc.inflight[seq]
+	if f != nil {
+		delete(cc.inflight, seq)
+		f.timer.Stop()
+	}
+	return f
+}
+
+// reader goroutine of a client connection
+func (cc *clientConn) readLoop() {
+	buf := make([]byte, 512)
+	var err error
+	for {
+		var rcv []byte
+		if rcv, err = readFrame(cc.conn, buf, cc.srv.maxFrameLength()); err != nil {
+			break
+		}
+		cc.srv.config.Logger.Info("tcp client rcv bytes: ", bytesToHexString(rcv))
+
+		commandId := uint32(bytesToIntBig(rcv[4:8]))
+		if commandId == pdu.CmdUnbind {
+			// the SGP closes the connection
+			var ub pdu.Unbind
+			if err = ub.UnmarshalBinary(rcv); err != nil {
+				break
+			}
+			var resp pdu.UnbindResp
+			resp.Sequence = ub.Sequence
+			sndbuf, _ := resp.MarshalBinary()
+			cc.write(sndbuf)
+			err = fmt.Errorf("connection is unbound by the SGP")
+			break
+		} else if commandId == pdu.CmdUnbindResp {
+			close(cc.unbound)
+			err = fmt.Errorf("connection is unbound")
+			break
+		} else if commandId != pdu.CmdSubmitResp {
+			cc.srv.config.Logger.Warnf("tcp client rcv unexpected command %08X", commandId)
+			continue
+		}
+
+		var resp pdu.SubmitResp
+		if err := resp.UnmarshalBinary(rcv); err != nil {
+			cc.srv.config.Logger.Warnf("tcp client rcv invalid submit resp:%s", err.Error())
+			continue
+		}
+		cc.srv.config.Logger.Debugf("tcp client rcv packet:%s", resp.String())
+		seq := Sequence(resp.Sequence)
+		f := cc.take(seq)
+		if f == nil {
+			cc.srv.config.Logger.Warnf("tcp client rcv submit resp of unknown sequence")
+			continue
+		}
+		<-cc.window
+
+		if resp.Result != resp_code_ok {
+			// the SGP refuse the submit, send back the result code
+			cc.srv.config.Logger.Warnf("submit is refused:%s", resp.String())
+			f.pending.finish(f.index, submitResult{"", int(resp.Result), respCodeMessage(int(resp.Result)), nil})
+		} else {
+			// submit successful, send back the sequence
+			f.pending.finish(f.index, submitResult{seq.String(), resp_code_ok, respCodeMessage(resp_code_ok), nil})
+		}
+	}
+
+	// the connection is broken, fail all the submits in flight
+	cc.close(err)
+	cc.lock.Lock()
+	err = cc.closeErr
+	inflight := cc.inflight
+	cc.inflight = make(map[Sequence]*inflightSubmit)
+	cc.lock.Unlock()
+	cc.srv.config.Logger.Debugf("tcp client connection closed:%s", err.Error())
+	for _, f := range inflight {
+		f.timer.Stop()
+		<-cc.window
+		f.pending.finish(f.index, submitResult{"", SUBMIT_CODE_NO_RESP, "no submit resp: " + err.Error(), nil})
+	}
+}
+
+func (srv *Server) getConnection(conn net.Conn, connActive bool) (net.Conn, error) {
+	var err error
+	if connActive == false {
+		if conn, err = srv.getNewConnection(); err != nil {
+			return nil, err
+		}
+
+		// send bind
+		var resp pdu.BindResp
+		bindMsg, err := srv.newBind()
+		if err == nil {
+			err = srv.sendBind(conn, bindMsg, &resp)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if resp.Result != resp_code_ok {
+			conn.Close()
+			return nil, fmt.Errorf("bind is refused, result %d: %s", resp.Result, respCodeMessage(int(resp.Result)))
+		}
+	}
+
+	return conn, nil
+}
+
+// send bind, then wait and decode the response
+func (srv *Server) sendBind(conn net.Conn, b *pdu.Bind, resp *pdu.BindResp) error {
+	buf, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(srv.config.WriteTimeoutSecond)))
+	srv.config.Logger.Info("tcp client goroutine prepare to send: ", bytesToHexString(buf))
+	_, err = conn.Write(buf)
+	if err != nil {
+		return err
+	} else {
+		conn.SetWriteDeadline(time.Time{})
+	}
+
+	srv.config.Logger.Debug("send over")
+
+	// receive bind resp
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(srv.config.ReadTimeoutSecond)))
+	rcv, err := readFrame(conn, nil, srv.maxFrameLength())
+	if err != nil {
+		return err
+	} else {
+		srv.config.Logger.Info("tcp client rcv bytes: ", bytesToHexString(rcv))
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	if err = resp.UnmarshalBinary(rcv); err != nil {
+		return fmt.Errorf("invalid bind resp: %s", err.Error())
+	}
+	srv.config.Logger.Debugf("tcp client rcv packet:%s", resp.String())
+
+	return nil
+}
+
+// send a trace on a new connection, then wait the trace resp. The
+// connection is unbound after that, so the SGP doesn't count it as open.
+func (srv *Server) sendTrace(t *pdu.Trace) (*pdu.TraceResp, error) {
+	buf, err := t.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := srv.getConnection(nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer srv.unbindConnection(conn)
+
+	conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(srv.config.WriteTimeoutSecond)))
+	srv.config.Logger.Info("trace prepare to send: ", bytesToHexString(buf))
+	if _, err = conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	// the trace resp has one record for every node
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(srv.config.ReadTimeoutSecond)))
+	rcv, err := readFrame(conn, nil, srv.maxFrameLength())
+	if err != nil {
+		return nil, err
+	}
+	srv.config.Logger.Info("trace rcv bytes: ", bytesToHexString(rcv))
+
+	var resp pdu.TraceResp
+	if err = resp.UnmarshalBinary(rcv); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// send unbind on a connection without other commands in flight, wait the
+// unbind resp, then close it
+func (srv *Server) unbindConnection(conn net.Conn) {
+	defer conn.Close()
+
+	seq, err := srv.newSequence()
+	if err != nil {
+		srv.config.Logger.Warnf("send unbind error:%s", err.Error())
+		return
+	}
+	var ub pdu.Unbind
+	ub.Sequence = [3]uint32(seq)
+	buf, _ := ub.MarshalBinary()
+	conn.SetWriteDeadline(time.Now().Add(time.Second * time.Duration(srv.config.WriteTimeoutSecond)))
+	if _, err = conn.Write(buf); err != nil {
+		srv.config.Logger.Warnf("send unbind error:%s", err.Error())
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(srv.config.ReadTimeoutSecond)))
+	rcv, err := readFrame(conn, nil, srv.maxFrameLength())
+	if err == nil {
+		var resp pdu.UnbindResp
+		err = resp.UnmarshalBinary(rcv)
+	}
+	if err != nil {
+		srv.config.Logger.Warnf("unbind resp error:%s", err.Error())
+	}
+}
+
+func (srv *Server) getNewConnection() (net.Conn, error) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(srv.config.SgpIp, strconv.Itoa(srv.config.SgpPort)))
+	return conn, err
+}
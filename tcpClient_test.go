@@ -0,0 +1,303 @@
+package sgip
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+	"github.com/liuben/sgip/pdu"
+)
+
+// a fake SGP which accepts every bind and submit, but never answers the
+// submits whose content is "drop", and refuses those whose content is
+// "refuse" with result 88. It answers a trace with one node, and closes the
+// connection after an unbind.
+type fakeSgp struct {
+	ln      net.Listener
+	conns   int32
+	unbinds int32
+}
+
+func newFakeSgp(t *testing.T) *fakeSgp {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSgp{ln: ln}
+	go s.serve()
+	return s
+}
+
+func (s *fakeSgp) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		go s.handle(c)
+	}
+}
+
+func (s *fakeSgp) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		f, err := readFrame(c, nil, 4096)
+		if err != nil {
+			return
+		}
+		p, err := pdu.Decode(f)
+		if err != nil {
+			return
+		}
+
+		var resp pdu.PDU
+		switch p := p.(type) {
+		case *pdu.Bind:
+			resp = &pdu.BindResp{}
+		case *pdu.Submit:
+			if string(p.MessageContent) == "drop" {
+				continue
+			}
+			if string(p.MessageContent) == "refuse" {
+				resp = &pdu.SubmitResp{Result: 88}
+			} else {
+				resp = &pdu.SubmitResp{}
+			}
+		case *pdu.Trace:
+			resp = &pdu.TraceResp{Nodes: []pdu.TraceNode{{NodeId: "88888", ReceiveTime: "261018120000", SendTime: "261018120001"}}}
+		case *pdu.Unbind:
+			atomic.AddInt32(&s.unbinds, 1)
+			resp = &pdu.UnbindResp{}
+		default:
+			continue
+		}
+		resp.Head().Sequence = p.Head().Sequence
+		b, _ := resp.MarshalBinary()
+		c.Write(b)
+		if _, ok := p.(*pdu.Unbind); ok {
+			return
+		}
+	}
+}
+
+func (s *fakeSgp) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestSubmitRespTimeout(t *testing.T) {
+	sgp := newFakeSgp(t)
+	defer sgp.ln.Close()
+
+	srv, err := NewServer(&SgipConfig{SgpIp: "127.0.0.1", SgpPort: sgp.port(), ReadTimeoutSecond: 1, WriteTimeoutSecond: 1, Logger: seelog.Disabled, SubmitWindowSize: 2, SubmitQueueDepth: 10, TcpClientCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.clientWait.Add(1)
+	go srv.tcpClientLoop()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	}()
+
+	submit := func(content string) chan submitResult {
+		rc := make(chan submitResult, 1)
+		srv.submitChan <- submitMessage{para: []submitInput{{userNumber: []string{"1"}, msgContent: []byte(content), reserve: make([]byte, 8)}}, responseChan: rc}
+		return rc
+	}
+
+	dropped := submit("drop")
+	var wg sync.WaitGroup
+	// more submits than the window, they only pass if the slot of the
+	// dropped one is freed, or they have a slot of their own
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(rc chan submitResult) {
+			defer wg.Done()
+			if r := <-rc; r.result != resp_code_ok {
+				t.Errorf("submit result %d %s", r.result, r.message)
+			}
+		}(submit("hello"))
+	}
+
+	select {
+	case r := <-dropped:
+		if r.result != SUBMIT_CODE_NO_RESP || r.message != "submit resp timeout" {
+			t.Errorf("dropped submit result %d %s", r.result, r.message)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("dropped submit is not timeout")
+	}
+	wg.Wait()
+
+	// the timeout doesn't close the connection
+	if r := <-submit("hello"); r.result != resp_code_ok {
+		t.Errorf("submit after timeout result %d %s", r.result, r.message)
+	}
+	if n := atomic.LoadInt32(&sgp.conns); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+func TestStopKeepsQueuedSubmits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDepth: 2, SubmitQueueDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := srv.submitJob(context.Background(), jobRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := make(chan error, 1)
+	go func() {
+		result, err := srv.Submit(context.Background(), jobRequest)
+		if err == ErrSubmitQueued && result.Code != SUBMIT_CODE_QUEUED {
+			t.Errorf("queued submit code %d", result.Code)
+		}
+		submitted <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Stop times out before the tcp client goroutine drains the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv.Stop(ctx)
+	(&tcpClient{srv: srv}).stop()
+
+	if err = <-submitted; err != ErrSubmitQueued {
+		t.Errorf("submit error %v, want ErrSubmitQueued", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if j = srv.findJob(j.Id); j.State != JOB_STATE_QUEUED {
+		t.Errorf("job state %s, want %s", j.State, JOB_STATE_QUEUED)
+	}
+
+	// both are sent after restart
+	srv, err = NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SubmitQueueDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.queue.close()
+	if n := len(srv.queue.entries()); n != 2 {
+		t.Errorf("%d submits in the log, want 2", n)
+	}
+	if srv.findJob(j.Id) == nil {
+		t.Errorf("job %s is not restored", j.Id)
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	sgp := newFakeSgp(t)
+	defer sgp.ln.Close()
+
+	srv, err := NewServer(&SgipConfig{SgpIp: "127.0.0.1", SgpPort: sgp.port(), ReadTimeoutSecond: 1, WriteTimeoutSecond: 1,
+		Logger: seelog.Disabled, TcpClientCount: 1, SpAppIp: "192.0.2.1", CorpId: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		result  int
+		nodes   int
+		unbinds int32
+	}{
+		{"ok", "submitSeq=3000012345+1018120000+1&userNumber=8613000000000", SUBMIT_OK, 1, 1},
+		{"bad sequence", "submitSeq=1&userNumber=8613000000000", SUBMIT_ERR, 0, 0},
+		{"no user number", "submitSeq=3000012345+1018120000+1", SUBMIT_ERR, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unbinds := atomic.LoadInt32(&sgp.unbinds)
+			w := httptest.NewRecorder()
+			srv.traceHandler(w, httptest.NewRequest("GET", "/trace?"+tt.query, nil))
+
+			var resp traceResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Result != tt.result || len(resp.Nodes) != tt.nodes {
+				t.Fatalf("trace response %+v, want result %d with %d nodes", resp, tt.result, tt.nodes)
+			}
+			if tt.nodes > 0 && resp.Nodes[0] != (traceNode{0, "88888", "261018120000", "261018120001"}) {
+				t.Errorf("trace node %+v", resp.Nodes[0])
+			}
+			// the trace connection is unbound before it is closed
+			if n := atomic.LoadInt32(&sgp.unbinds) - unbinds; n != tt.unbinds {
+				t.Errorf("%d unbinds, want %d", n, tt.unbinds)
+			}
+		})
+	}
+}
+
+func TestProcessMarksSegmentWhenWritten(t *testing.T) {
+	sgp := newFakeSgp(t)
+	defer sgp.ln.Close()
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := NewServer(&SgipConfig{SgpIp: "127.0.0.1", SgpPort: sgp.port(), ReadTimeoutSecond: 1, WriteTimeoutSecond: 1, Logger: seelog.Disabled,
+		SubmitWindowSize: 1, SubmitQueueDepth: 1, TcpClientCount: 1, SubmitQueueDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.queue.close()
+
+	rc := make(chan submitResult, 1)
+	var para []submitInput
+	for _, content := range []string{"drop", "a", "b"} {
+		para = append(para, submitInput{userNumber: []string{"1"}, msgContent: []byte(content), reserve: make([]byte, 8)})
+	}
+	if err = srv.enqueueSubmit(context.Background(), submitMessage{para: para, responseChan: rc}); err != nil {
+		t.Fatal(err)
+	}
+	srv.clientWait.Add(1)
+	go srv.tcpClientLoop()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		srv.Stop(ctx)
+	}()
+
+	// the first segment holds the only slot of the window until its resp
+	// timeout, the others are not written, so they are not marked
+	time.Sleep(300 * time.Millisecond)
+	entries := srv.queue.entries()
+	if len(entries) != 1 {
+		t.Fatalf("%d submits in the log, want 1", len(entries))
+	}
+	if sent := entries[0].Sent; !sent[0] || sent[1] || sent[2] {
+		t.Errorf("segments marked %v, want only the first", sent)
+	}
+
+	select {
+	case r := <-rc:
+		if r.result != SUBMIT_CODE_NO_RESP || len(r.sequences) != 2 {
+			t.Errorf("submit result %+v", r)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("submit is not done")
+	}
+	if n := len(srv.queue.entries()); n != 0 {
+		t.Errorf("%d submits left in the log, want 0", n)
+	}
+}
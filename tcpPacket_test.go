@@ -0,0 +1,105 @@
+package sgip
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+	"github.com/liuben/sgip/pdu"
+)
+
+func TestTraceProcess(t *testing.T) {
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, CorpId: 12345})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		result uint8
+	}{
+		{"bound", CONN_STATUS_BIND, resp_code_ok},
+		{"not bound", CONN_STATUS_INIT, resp_code_para_err},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m trace
+			m.Sequence = [3]uint32{3000012345, 1018120000, 7}
+			status := tt.status
+			resp, ok := m.Process(srv, &status).(*traceresp)
+			if !ok {
+				t.Fatal("trace is not answered with a trace resp")
+			}
+			if resp.Sequence != m.Sequence {
+				t.Errorf("resp sequence %v, want %v", resp.Sequence, m.Sequence)
+			}
+			if len(resp.Nodes) != 1 {
+				t.Fatalf("%d nodes, want 1", len(resp.Nodes))
+			}
+			n := resp.Nodes[0]
+			if n.Result != tt.result || n.NodeId != fmt.Sprintf("%05d", 12345) {
+				t.Errorf("node %+v, want result %d of node 12345", n, tt.result)
+			}
+			if n.ReceiveTime == "" || n.SendTime == "" {
+				t.Errorf("node %+v has no times", n)
+			}
+
+			// the resp is encoded as a trace resp
+			buf := make([]byte, 4096)
+			var got pdu.TraceResp
+			if err := got.UnmarshalBinary(buf[:resp.Encode(buf)]); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Nodes) != 1 || got.Nodes[0].Result != tt.result {
+				t.Errorf("encoded resp %+v", got)
+			}
+		})
+	}
+}
+
+func TestUserRptProcess(t *testing.T) {
+	srv, h := newConcatServer()
+
+	tests := []struct {
+		name   string
+		status int
+		result uint8
+	}{
+		{"bound", CONN_STATUS_BIND, resp_code_ok},
+		{"not bound", CONN_STATUS_INIT, resp_code_para_err},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m userrpt
+			m.Sequence = [3]uint32{3000012345, 1018120000, 8}
+			m.SpNumber = "10655"
+			m.UserNumber = "8613811234567"
+			m.UserCondition = 2
+			status := tt.status
+			resp, ok := m.Process(srv, &status).(*userrptresp)
+			if !ok {
+				t.Fatal("userrpt is not answered with a userrpt resp")
+			}
+			if resp.Sequence != m.Sequence || resp.Result != tt.result {
+				t.Errorf("resp %+v, want result %d", resp, tt.result)
+			}
+
+			select {
+			case e := <-h.events:
+				u, ok := e.(*UserRptEvent)
+				if tt.result != resp_code_ok || !ok {
+					t.Fatalf("unexpected event %#v", e)
+				}
+				if u.Sequence != Sequence(m.Sequence) || u.SpNumber != "10655" || u.UserNumber != "8613811234567" || u.UserCondition != 2 {
+					t.Errorf("userrpt event %+v", u)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.result == resp_code_ok {
+					t.Error("OnUserRpt is not called")
+				}
+			}
+		})
+	}
+}
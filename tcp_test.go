@@ -0,0 +1,126 @@
+package sgip
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cihub/seelog"
+	"github.com/liuben/sgip/pdu"
+)
+
+func TestEnqueueSubmitStop(t *testing.T) {
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, SubmitQueueDepth: 1, TcpClientCount: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := submitMessage{para: []submitInput{{userNumber: []string{"1"}}}, responseChan: make(chan submitResult, 1)}
+	if err = srv.enqueueSubmit(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the queue is full, so the submit waits until the server stops
+	blocked := make(chan error, 1)
+	go func() { blocked <- srv.enqueueSubmit(context.Background(), msg) }()
+	time.Sleep(100 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		stopped <- srv.Stop(ctx)
+	}()
+
+	select {
+	case err = <-blocked:
+		if err != ErrServerStopping {
+			t.Errorf("blocked submit error %v, want ErrServerStopping", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocked submit is not released by Stop")
+	}
+	if err = <-stopped; err != nil {
+		t.Errorf("Stop error %v", err)
+	}
+	if err = srv.enqueueSubmit(context.Background(), msg); err != ErrServerStopping {
+		t.Errorf("submit after stop error %v, want ErrServerStopping", err)
+	}
+}
+
+func TestHandleTcpConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	h := &eventHandler{make(chan interface{}, 16)}
+	srv, err := NewServer(&SgipConfig{Logger: seelog.Disabled, TcpClientCount: 1, SgpIp: "127.0.0.1", ReadTimeoutSecond: 1,
+		LoginUserName: "sgp", LoginPassword: "secret", Handler: h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.tcpServerLoop(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(p pdu.PDU) []byte {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	call := func(b []byte) pdu.PDU {
+		if _, err := conn.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		f, err := readFrame(conn, nil, 4096)
+		if err != nil {
+			return nil
+		}
+		p, err := pdu.Decode(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	bind := &pdu.Bind{LoginType: pdu.LoginSmgToSp, LoginName: "sgp", LoginPassword: "secret"}
+	if resp, ok := call(send(bind)).(*pdu.BindResp); !ok || resp.Result != resp_code_ok {
+		t.Fatalf("bind resp %v", resp)
+	}
+
+	deliver := &pdu.Deliver{UserNumber: "8613811234567", SpNumber: "10655", MessageContent: []byte("hello")}
+	deliver.Sequence = [3]uint32{3000012345, 1018120000, 1}
+	if resp, ok := call(send(deliver)).(*pdu.DeliverResp); !ok || resp.Result != resp_code_ok || resp.Sequence != deliver.Sequence {
+		t.Fatalf("deliver resp %v", resp)
+	}
+	select {
+	case e := <-h.events:
+		if d := e.(*DeliverEvent); string(d.MsgContent) != "hello" || d.UserNumber != "8613811234567" {
+			t.Errorf("deliver event %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("deliver is not handled")
+	}
+
+	// the message length field doesn't fit the command length, the deliver
+	// is not processed and the connection is closed
+	b := send(deliver)
+	b[68]++
+	if resp := call(b); resp != nil {
+		t.Errorf("broken deliver is answered with %v", resp)
+	}
+	select {
+	case e := <-h.events:
+		t.Errorf("broken deliver is handled: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
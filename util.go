@@ -3,16 +3,18 @@ package sgip
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strconv"
 )
 
-func logBytes(data []byte, prefix string) {
+func (srv *Server) logBytes(data []byte, prefix string) {
 	var buf bytes.Buffer
 	buf.WriteString(prefix)
 	for _, b := range data {
 		buf.WriteString(fmt.Sprintf(" %02X", b))
 	}
-	sgipConfig.Logger.Info(buf.String())
+	srv.config.Logger.Info(buf.String())
 }
 
 func bytesToIntBig(bytes []byte) int {
@@ -30,27 +32,6 @@ func intToBytesBig(i int, b []byte) {
 	b[3] = byte(i)
 }
 
-func decodeBytesString(bytes []byte) string {
-	var i int
-	for i = 0; i < len(bytes); i++ {
-		if bytes[i] == 0 {
-			break
-		}
-	}
-
-	return string(bytes[0:i])
-}
-
-func encodeStringBytes(s string, bytes []byte) {
-	for i := 0; i < len(bytes); i++ {
-		if i < len(s) {
-			bytes[i] = byte(s[i])
-		} else {
-			bytes[i] = 0
-		}
-	}
-}
-
 func bytesToHexString(in []byte) string {
 	var buf bytes.Buffer
 
@@ -75,3 +56,65 @@ func hexStringToBytes(s string) ([]byte, error) {
 
 	return res, nil
 }
+
+// write data to a temporary file, fsync and rename it, so the file always
+// holds complete data
+func writeFileSync(path string, data []byte) error {
+	tmp, err := writeTempSync(path, data)
+	if err != nil {
+		return err
+	}
+	return renameSync(tmp, path)
+}
+
+// write data to the temporary file of path and fsync it, it returns the
+// name of the temporary file
+func writeTempSync(path string, data []byte) (string, error) {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// rename the temporary file to path, and sync the directory
+func renameSync(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// sync the directory, so the rename survives a crash
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// append data to the file at path
+func appendFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func syncDir(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
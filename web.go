@@ -1,21 +1,51 @@
 package sgip
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
+
+	"github.com/liuben/sgip/pdu"
 )
 
 const (
 	SUBMIT_OK  = 0
 	SUBMIT_ERR = 1
+	// the submit is kept in the submit queue log, and sent after restart
+	SUBMIT_QUEUED = 2
+
+	// the code of a submit which got no submit resp from the SGP
+	SUBMIT_CODE_NO_RESP = -1
+	// the code of a submit kept in the submit queue log when the server stops
+	SUBMIT_CODE_QUEUED = -2
 )
 
 type submitResponse struct {
-	Result   int    `json:"result"`
-	Sequence string `json:"sequence"`
+	Result    int      `json:"result"`
+	Sequence  string   `json:"sequence"`
+	Sequences []string `json:"sequences"`
+	Code      int      `json:"code"`
+	Message   string   `json:"message"`
+}
+
+type traceResponse struct {
+	Result int         `json:"result"`
+	Nodes  []traceNode `json:"nodes"`
+}
+
+type traceNode struct {
+	Result      int    `json:"result"`
+	NodeId      string `json:"nodeId"`
+	ReceiveTime string `json:"receiveTime"`
+	SendTime    string `json:"sendTime"`
+}
+
+type deadCallbackResponse struct {
+	Result    int            `json:"result"`
+	Callbacks []*outboxEntry `json:"callbacks"`
 }
 
 type submitInput struct {
@@ -38,52 +68,92 @@ type submitInput struct {
 	msgCoding    byte
 	msgContent   []byte
 	reserve      []byte
+	callbackUrl  string // the url of the reports, it is not sent to the SGP
 }
 
-func startWebServer() {
-	http.HandleFunc("/submit", submitHandler)
+func (srv *Server) startWebServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/submit", srv.submitHandler)
+	mux.HandleFunc("/trace", srv.traceHandler)
+	mux.HandleFunc("/callback/dead", srv.deadCallbackHandler)
+	mux.HandleFunc("/v1/messages", srv.messagesHandler)
+	mux.HandleFunc("/v1/messages/batch", srv.batchHandler)
+	mux.HandleFunc("/v1/messages/", srv.messageJobHandler)
+	mux.HandleFunc("/v1/status/", srv.messageStatusHandler)
+
+	port := fmt.Sprintf(":%d", srv.config.SpWebListenPort)
+	srv.stopLock.Lock()
+	if srv.stopping {
+		srv.stopLock.Unlock()
+		return
+	}
+	srv.webServer = &http.Server{Addr: port, Handler: mux}
+	srv.stopLock.Unlock()
 
-	port := fmt.Sprintf(":%d", sgipConfig.SpWebListenPort)
+	if err := srv.webServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		srv.config.Logger.Errorf("web listen error :%s", err.Error())
+	}
+}
 
-	if err := http.ListenAndServe(port, nil); err != nil {
-		sgipConfig.Logger.Errorf("web listen error :%s", err.Error())
+// stop accepting requests, and wait the running requests
+func (srv *Server) stopWebServer(ctx context.Context) error {
+	srv.stopLock.RLock()
+	server := srv.webServer
+	srv.stopLock.RUnlock()
+	if server == nil {
+		return nil
 	}
+
+	return server.Shutdown(ctx)
 }
 
-func submitHandler(w http.ResponseWriter, r *http.Request) {
-	sgipConfig.Logger.Infof("get submit request: %s", r.URL.String())
+func (srv *Server) submitHandler(w http.ResponseWriter, r *http.Request) {
+	srv.config.Logger.Infof("get submit request: %s", r.URL.String())
 
-	var result submitResponse
+	result := submitResponse{Sequences: []string{}}
 	// check ip
-	if checkClientIp(r.RemoteAddr, sgipConfig.SpAppIp) == false {
+	if srv.checkClientIp(r.RemoteAddr, srv.config.SpAppIp) == false {
 		result.Result = SUBMIT_ERR
 		result.Sequence = ""
+		result.Code = SUBMIT_CODE_NO_RESP
+		result.Message = "client ip is not allowed"
 		res, _ := json.Marshal(result)
-		fmt.Fprintf(w, string(res))
+		fmt.Fprint(w, string(res))
 		return
 	}
 
 	// get input
 	r.ParseForm()
-	input := parseSubmit(&r.Form)
+	input := srv.parseSubmit(&r.Form)
 	if input == nil {
-		sgipConfig.Logger.Warn("submit request is invalid")
+		srv.config.Logger.Warn("submit request is invalid")
 		result.Result = SUBMIT_ERR
 		result.Sequence = ""
+		result.Code = SUBMIT_CODE_NO_RESP
+		result.Message = "submit request is invalid"
 		res, _ := json.Marshal(result)
-		fmt.Fprintf(w, string(res))
+		fmt.Fprint(w, string(res))
 		return
 	}
 
-	// send message to channel
-	rc := make(chan string)
-	msg := submitMessage{*input, rc}
-	sgipConfig.Logger.Debug("web goroutine prepares to send msg to submitChan channel")
-	submitChan <- msg
-	sgipConfig.Logger.Debug("web goroutine prepares to wait the response from submitChan.Sequence channel")
-	result.Sequence = <-rc
-	sgipConfig.Logger.Debug("web goroutine gets the response from submitChan.Sequence channel")
-	if len(result.Sequence) != 24 {
+	// send the message and wait the result
+	sr, err := srv.submit(r.Context(), input, "")
+	if err != nil {
+		srv.config.Logger.Warnf("submit request is rejected: %s", err.Error())
+		result.Result = SUBMIT_ERR
+		result.Code = SUBMIT_CODE_NO_RESP
+		result.Message = err.Error()
+		res, _ := json.Marshal(result)
+		fmt.Fprint(w, string(res))
+		return
+	}
+	result.Sequence = sr.sequence
+	result.Sequences = sr.sequences
+	result.Code = sr.result
+	result.Message = sr.message
+	if sr.result == SUBMIT_CODE_QUEUED {
+		result.Result = SUBMIT_QUEUED
+	} else if len(result.Sequence) != 24 {
 		result.Result = SUBMIT_ERR
 	} else {
 		result.Result = SUBMIT_OK
@@ -91,16 +161,87 @@ func submitHandler(w http.ResponseWriter, r *http.Request) {
 
 	// return the response
 	res, _ := json.Marshal(result)
-	fmt.Fprintf(w, string(res))
+	fmt.Fprint(w, string(res))
 }
 
-func parseSubmit(form *url.Values) *submitInput {
+func (srv *Server) traceHandler(w http.ResponseWriter, r *http.Request) {
+	srv.config.Logger.Infof("get trace request: %s", r.URL.String())
+
+	result := traceResponse{Result: SUBMIT_ERR, Nodes: []traceNode{}}
+	// check ip
+	if srv.checkClientIp(r.RemoteAddr, srv.config.SpAppIp) == false {
+		res, _ := json.Marshal(result)
+		fmt.Fprint(w, string(res))
+		return
+	}
+
+	// get input
+	r.ParseForm()
+	submitSeq, err := ParseSequence(r.Form.Get("submitSeq"))
+	userNumber := r.Form.Get("userNumber")
+	if err != nil || userNumber == "" {
+		srv.config.Logger.Warn("trace request is invalid")
+		res, _ := json.Marshal(result)
+		fmt.Fprint(w, string(res))
+		return
+	}
+
+	// send trace and wait the response
+	var resp *pdu.TraceResp
+	t, err := srv.newTrace(submitSeq, userNumber)
+	if err == nil {
+		resp, err = srv.sendTrace(t)
+	}
+	if err != nil {
+		srv.config.Logger.Errorf("send trace error:%s", err.Error())
+		res, _ := json.Marshal(result)
+		fmt.Fprint(w, string(res))
+		return
+	}
+
+	result.Result = SUBMIT_OK
+	for _, n := range resp.Nodes {
+		result.Nodes = append(result.Nodes, traceNode{int(n.Result), n.NodeId, n.ReceiveTime, n.SendTime})
+	}
+
+	// return the response
+	res, _ := json.Marshal(result)
+	fmt.Fprint(w, string(res))
+}
+
+// list the callbacks which failed until the max age
+func (srv *Server) deadCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	srv.config.Logger.Infof("get dead callback request: %s", r.URL.String())
+
+	result := deadCallbackResponse{Result: SUBMIT_ERR, Callbacks: []*outboxEntry{}}
+	// check ip
+	if srv.checkClientIp(r.RemoteAddr, srv.config.SpAppIp) == false || srv.outbox == nil {
+		res, _ := json.Marshal(result)
+		fmt.Fprint(w, string(res))
+		return
+	}
+
+	callbacks, err := srv.outbox.dead()
+	if err != nil {
+		srv.config.Logger.Errorf("read dead callbacks error:%s", err.Error())
+		res, _ := json.Marshal(result)
+		fmt.Fprint(w, string(res))
+		return
+	}
+
+	result.Result = SUBMIT_OK
+	result.Callbacks = callbacks
+	res, _ := json.Marshal(result)
+	fmt.Fprint(w, string(res))
+}
+
+func (srv *Server) parseSubmit(form *url.Values) *submitInput {
 	var s submitInput
 
 	if str := form.Get("spNumber"); str != "" {
 		s.spNumber = str
 	} else {
-		sgipConfig.Logger.Warn("no spNumber")
+		srv.config.Logger.Warn("no spNumber")
 		return nil
 	}
 
@@ -108,7 +249,7 @@ func parseSubmit(form *url.Values) *submitInput {
 
 	s.userNumber = make([]string, 0, 5)
 	if uns, ok := (*form)["userNumber"]; ok == false {
-		sgipConfig.Logger.Warn("no userNumber")
+		srv.config.Logger.Warn("no userNumber")
 		return nil
 	} else {
 		for _, un := range uns {
@@ -119,150 +260,161 @@ func parseSubmit(form *url.Values) *submitInput {
 	if str := form.Get("corpId"); str != "" {
 		s.corpId = str
 	} else {
-		sgipConfig.Logger.Warn("no corpId")
+		srv.config.Logger.Warn("no corpId")
 		return nil
 	}
 
 	if str := form.Get("serviceType"); str != "" {
 		s.serviceType = str
 	} else {
-		sgipConfig.Logger.Warn("no serviceType")
+		srv.config.Logger.Warn("no serviceType")
 		return nil
 	}
 
 	if str := form.Get("feeType"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("feeType format is error")
+			srv.config.Logger.Warn("feeType format is error")
 			return nil
 		}
 		s.feeType = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no serviceType")
+		srv.config.Logger.Warn("no serviceType")
 		return nil
 	}
 
 	if str := form.Get("feeValue"); str != "" {
 		s.feeValue = str
 	} else {
-		sgipConfig.Logger.Warn("no feeValue")
+		srv.config.Logger.Warn("no feeValue")
 		return nil
 	}
 
 	if str := form.Get("givenValue"); str != "" {
 		s.givenValue = str
 	} else {
-		sgipConfig.Logger.Warn("no givenValue")
+		srv.config.Logger.Warn("no givenValue")
 		return nil
 	}
 
 	if str := form.Get("agentFlag"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("agentFlag format is error")
+			srv.config.Logger.Warn("agentFlag format is error")
 			return nil
 		}
 		s.agentFlag = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no agentFlag")
+		srv.config.Logger.Warn("no agentFlag")
 		return nil
 	}
 
 	if str := form.Get("mtFlag"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("mtFlag format is error")
+			srv.config.Logger.Warn("mtFlag format is error")
 			return nil
 		}
 		s.mtFlag = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no mtFlag")
+		srv.config.Logger.Warn("no mtFlag")
 		return nil
 	}
 
 	if str := form.Get("priority"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("priority format is error")
+			srv.config.Logger.Warn("priority format is error")
 			return nil
 		}
 		s.priority = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no priority")
+		srv.config.Logger.Warn("no priority")
 		return nil
 	}
 
 	if str := form.Get("expireTime"); str != "" {
 		s.expireTime = str
 	} else {
-		sgipConfig.Logger.Warn("no expireTime")
+		srv.config.Logger.Warn("no expireTime")
 		return nil
 	}
 
 	if str := form.Get("scheduleTime"); str != "" {
 		s.scheduleTime = str
 	} else {
-		sgipConfig.Logger.Warn("no scheduleTime")
+		srv.config.Logger.Warn("no scheduleTime")
 		return nil
 	}
 
 	if str := form.Get("reportFlag"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("reportFlag format is error")
+			srv.config.Logger.Warn("reportFlag format is error")
 			return nil
 		}
 		s.reportFlag = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no reportFlag")
+		srv.config.Logger.Warn("no reportFlag")
 		return nil
 	}
 
 	if str := form.Get("tppid"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("tppid format is error")
+			srv.config.Logger.Warn("tppid format is error")
 			return nil
 		}
 		s.tppid = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no tppid")
+		srv.config.Logger.Warn("no tppid")
 		return nil
 	}
 
 	if str := form.Get("tpudhi"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("tpudhi format is error")
+			srv.config.Logger.Warn("tpudhi format is error")
 			return nil
 		}
 		s.tpudhi = byte(v)
 	} else {
-		sgipConfig.Logger.Warn("no tpudhi")
+		srv.config.Logger.Warn("no tpudhi")
 		return nil
 	}
 
+	// with text, msgCoding is optional and chosen by the text
+	text := form.Get("text")
+	msgCoding := -1
 	if str := form.Get("msgCoding"); str != "" {
 		v, err := strconv.ParseUint(str, 16, 8)
 		if err != nil {
-			sgipConfig.Logger.Warn("msgCoding format is error")
+			srv.config.Logger.Warn("msgCoding format is error")
 			return nil
 		}
 		s.msgCoding = byte(v)
-	} else {
-		sgipConfig.Logger.Warn("no msgCoding")
+		msgCoding = int(v)
+	} else if text == "" {
+		srv.config.Logger.Warn("no msgCoding")
 		return nil
 	}
 
-	if str := form.Get("msgContent"); str != "" {
+	if text != "" {
+		var err error
+		s.msgCoding, s.msgContent, err = encodeText(text, msgCoding)
+		if err != nil {
+			srv.config.Logger.Warnf("text encode error: %s", err.Error())
+			return nil
+		}
+	} else if str := form.Get("msgContent"); str != "" {
 		var err error
 		s.msgContent, err = hexStringToBytes(str)
 		if err != nil {
-			sgipConfig.Logger.Warn("msgContent format is error")
+			srv.config.Logger.Warn("msgContent format is error")
 			return nil
 		}
 	} else {
-		sgipConfig.Logger.Warn("no msgContent")
+		srv.config.Logger.Warn("no msgContent")
 		return nil
 	}
 
@@ -270,13 +422,22 @@ func parseSubmit(form *url.Values) *submitInput {
 		var err error
 		s.reserve, err = hexStringToBytes(str)
 		if err != nil || len(s.reserve) != 8 {
-			sgipConfig.Logger.Warn("reserve format is error")
+			srv.config.Logger.Warn("reserve format is error")
 			return nil
 		}
 	} else {
-		sgipConfig.Logger.Warn("no reserve")
+		srv.config.Logger.Warn("no reserve")
 		return nil
 	}
 
+	// the reports of this submit are called back to callbackUrl
+	if str := form.Get("callbackUrl"); str != "" {
+		if err := checkCallbackUrl(str); err != nil {
+			srv.config.Logger.Warn(err.Error())
+			return nil
+		}
+		s.callbackUrl = str
+	}
+
 	return &s
 }